@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/stepro/kdo/pkg/await"
+)
+
+var cmd = &cobra.Command{
+	Short: "Kdo await: wait for images built on a node",
+	Use:   "kdo-await [--keep N] image...",
+	Args:  cobra.MinimumNArgs(1),
+	RunE:  run,
+}
+
+var flags struct {
+	keep     int
+	interval time.Duration
+}
+
+func init() {
+	cmd.Flags().IntVar(&flags.keep,
+		"keep", 0, "number of images to keep in each repository")
+	cmd.Flags().DurationVar(&flags.interval,
+		"interval", 1*time.Second, "interval between checks for images")
+
+	// Do not show usage if there is an error
+	cmd.SilenceUsage = true
+
+	// Do not show errors in the default manner
+	cmd.SilenceErrors = true
+}
+
+func run(cmd *cobra.Command, images []string) error {
+	r, err := await.Detect()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err = await.Wait(r, images, flags.interval); err != nil {
+		return err
+	}
+
+	if flags.keep > 0 {
+		return await.Prune(r, images, flags.keep)
+	}
+
+	return nil
+}
+
+func main() {
+	if err := cmd.Execute(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -30,4 +30,7 @@ echo Packaging Windows binary...
 cd bin/windows/amd64
 sudo chown 0:0 kdo.exe
 zip ../../../rel/kdo-v$VERSION-windows-amd64.zip kdo.exe
-cd ../../..
\ No newline at end of file
+cd ../../..
+echo Building await image...
+docker buildx build --platform linux/amd64,linux/arm64 \
+  --file ../kdo-await/Dockerfile --tag stepro/kdo-await:$VERSION --push ../..
@@ -6,22 +6,25 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/stepro/kdo/pkg/buildctl"
 	"github.com/stepro/kdo/pkg/docker"
+	"github.com/stepro/kdo/pkg/doctor"
 	"github.com/stepro/kdo/pkg/filesync"
 	"github.com/stepro/kdo/pkg/imagebuild"
 	"github.com/stepro/kdo/pkg/kubectl"
+	"github.com/stepro/kdo/pkg/listener"
 	"github.com/stepro/kdo/pkg/output"
 	"github.com/stepro/kdo/pkg/pod"
 	"github.com/stepro/kdo/pkg/portforward"
+	"github.com/stepro/kdo/pkg/registry"
 	"github.com/stepro/kdo/pkg/replacer"
 	"github.com/stepro/kdo/pkg/server"
 )
@@ -37,7 +40,9 @@ var cmd = &cobra.Command{
 var usage = strings.TrimSpace(`
   kdo [flags] image [command] [args...]
   kdo [flags] build-dir [command] [args...]
-  kdo --[un]install [-q, --quiet] [-v, --verbose] [--debug]
+  kdo --[un]install [--server-*] [-q, --quiet] [-v, --verbose] [--debug] [--json]
+  kdo --server-status | --server-rollback [--server-*] [-q, --quiet] [-v, --verbose] [--debug] [--json]
+  kdo --doctor [--server-*] [--builder ...] [-q, --quiet] [-v, --verbose] [--debug] [--json]
   kdo --version | --help
 `)
 
@@ -78,13 +83,21 @@ var examples = strings.Trim(`
 
 var flags struct {
 	kubectl struct {
-		path string
+		path   string
+		native bool
 		kubectl.Options
 	}
 	install   bool
 	uninstall bool
-	scope     string
-	build     struct {
+	doctor    bool
+	server    struct {
+		nodeSelector []string
+		server.Options
+		status   bool
+		rollback bool
+	}
+	scope string
+	build struct {
 		builder  string
 		buildctl struct {
 			path string
@@ -94,7 +107,13 @@ var flags struct {
 			path string
 			docker.Options
 		}
+		kaniko imagebuild.KanikoOptions
 		imagebuild.Options
+		keep       int
+		always     bool
+		registry   string
+		containers []string
+		await      string
 	}
 	config struct {
 		inherit            string
@@ -104,15 +123,26 @@ var flags struct {
 		annotations        []string
 		podSpec            string
 		spec               string
+		patchType          string
 		env                []string
 		noLifecycle        bool
 		noProbes           bool
 	}
 	replace bool
+	steer   []string
 	session struct {
-		sync    []string
-		forward []string
-		listen  []string
+		sync        []string
+		syncOptions filesync.Options
+		syncRun     []string
+		syncRestart []string
+		syncChown   []string
+		syncChmod   []string
+		syncExclude []string
+		syncInclude []string
+		syncBack    []string
+		forward     []string
+		listen      []string
+		listenImage string
 	}
 	command struct {
 		exec    bool
@@ -127,6 +157,7 @@ var flags struct {
 		quiet   bool
 		verbose bool
 		debug   bool
+		json    bool
 	}
 }
 
@@ -141,6 +172,8 @@ func init() {
 	// Kubernetes flags
 	cmd.Flags().StringVar(&flags.kubectl.path,
 		"kubectl", "kubectl", "path to the kubectl CLI")
+	cmd.Flags().BoolVar(&flags.kubectl.native,
+		"kubectl-native", false, "use a built-in kubectl instead of the kubectl CLI")
 	cmd.Flags().StringVar(&flags.kubectl.Kubeconfig,
 		"kubeconfig", "", "path to the kubeconfig file to use")
 	cmd.Flags().StringVar(&flags.kubectl.Context,
@@ -155,6 +188,28 @@ func init() {
 		"install", false, "install server components and exit")
 	cmd.Flags().BoolVar(&flags.uninstall,
 		"uninstall", false, "uninstall server components and exit")
+	cmd.Flags().BoolVar(&flags.server.status,
+		"server-status", false, "report the versions of server components and exit")
+	cmd.Flags().BoolVar(&flags.server.rollback,
+		"server-rollback", false, "roll back server components to their previous version and exit")
+
+	// Diagnostics flag
+	cmd.Flags().BoolVar(&flags.doctor,
+		"doctor", false, "check that the cluster is ready for kdo and exit")
+
+	// Server flags
+	cmd.Flags().StringVar(&flags.server.Image,
+		"server-image", "moby/buildkit", "image that runs the server components")
+	cmd.Flags().StringVar(&flags.server.Namespace,
+		"server-namespace", "kube-system", "namespace of the server components")
+	cmd.Flags().StringArrayVar(&flags.server.nodeSelector,
+		"server-node-selector", nil, "restrict the nodes that run server components")
+	cmd.Flags().StringArrayVar(&flags.server.Tolerations,
+		"server-toleration", nil, "tolerate node taints for server components")
+	cmd.Flags().BoolVar(&flags.server.OnDemand,
+		"server-on-demand", false, "only run server components on nodes as needed")
+	cmd.Flags().IntVar(&flags.server.CacheSize,
+		"server-cache-size", 10000, "size in MB at which the build cache on a node is pruned")
 
 	// Scope flag
 	cmd.Flags().StringVar(&flags.scope,
@@ -173,12 +228,36 @@ func init() {
 		"docker-config", "", "path to the docker CLI config files")
 	cmd.Flags().StringVar(&flags.build.docker.LogLevel,
 		"docker-log-level", "", "the docker CLI logging level")
+	cmd.Flags().StringVar(&flags.build.kaniko.Image,
+		"kaniko-image", "gcr.io/kaniko-project/executor:debug", "the kaniko executor image")
+	cmd.Flags().StringVar(&flags.build.kaniko.Secret,
+		"kaniko-secret", "", "secret with credentials for the registry")
 	cmd.Flags().StringVarP(&flags.build.File,
 		"build-file", "f", "Dockerfile", "dockerfile to build")
 	cmd.Flags().StringArrayVar(&flags.build.Args,
 		"build-arg", nil, "build-time variables")
 	cmd.Flags().StringVar(&flags.build.Target,
 		"build-target", "", "dockerfile target to build")
+	cmd.Flags().StringArrayVar(&flags.build.Secrets,
+		"build-secret", nil, "secrets to expose to the build")
+	cmd.Flags().StringArrayVar(&flags.build.SSH,
+		"build-ssh", nil, "SSH agent sockets or keys to expose to the build")
+	cmd.Flags().StringArrayVar(&flags.build.Contexts,
+		"build-context", nil, "additional named build contexts")
+	cmd.Flags().StringVar(&flags.build.Platform,
+		"build-platform", "", "target platform of the build")
+	cmd.Flags().BoolVar(&flags.build.NoCache,
+		"no-cache", false, "do not use the build cache")
+	cmd.Flags().IntVar(&flags.build.keep,
+		"build-keep", 3, "number of built images to keep")
+	cmd.Flags().BoolVar(&flags.build.always,
+		"build-always", false, "build even if the build context is unchanged")
+	cmd.Flags().StringVar(&flags.build.registry,
+		"registry", "", "build locally and push to a registry")
+	cmd.Flags().StringArrayVar(&flags.build.containers,
+		"container-build", nil, "build images for other containers")
+	cmd.Flags().StringVar(&flags.build.await,
+		"await-image", "stepro/kdo-await:"+cmd.Version, "image that awaits images built on a node")
 
 	// Configuration flags
 	cmd.Flags().StringVarP(&flags.config.inherit,
@@ -195,6 +274,8 @@ func init() {
 		"pod-spec", "", "customize overall pod configuration")
 	cmd.Flags().StringVar(&flags.config.spec,
 		"spec", "", "customize overall container configuration")
+	cmd.Flags().StringVar(&flags.config.patchType,
+		"patch-type", "merge", "the type of patch used by spec flags")
 	cmd.Flags().StringArrayVarP(&flags.config.env,
 		"env", "e", nil, "set container environment variables")
 	cmd.Flags().BoolVar(&flags.config.noLifecycle,
@@ -202,17 +283,40 @@ func init() {
 	cmd.Flags().BoolVar(&flags.config.noProbes,
 		"no-probes", false, "do not inherit container probes")
 
-	// Replace flag
+	// Replace flags
 	cmd.Flags().BoolVarP(&flags.replace,
 		"replace", "R", false, "overlay inherited configuration's workload")
+	cmd.Flags().StringArrayVar(&flags.steer,
+		"steer", nil, "steer traffic to the pod instead of scaling the workload")
 
 	// Session flags
 	cmd.Flags().StringArrayVarP(&flags.session.sync,
 		"sync", "s", nil, "push local file changes to the container")
+	cmd.Flags().BoolVar(&flags.session.syncOptions.Digest,
+		"sync-digest", false, "only push files whose content differs")
+	cmd.Flags().BoolVar(&flags.session.syncOptions.Agent,
+		"sync-agent", false, "inject tools used to synchronize files")
+	cmd.Flags().StringArrayVar(&flags.session.syncRun,
+		"sync-run", nil, "run a command after pushing file changes")
+	cmd.Flags().StringArrayVar(&flags.session.syncRestart,
+		"sync-restart", nil, "restart the command after pushing file changes")
+	cmd.Flags().Lookup("sync-restart").NoOptDefVal = "*"
+	cmd.Flags().StringArrayVar(&flags.session.syncChown,
+		"sync-chown", nil, "set the owner of pushed files")
+	cmd.Flags().StringArrayVar(&flags.session.syncChmod,
+		"sync-chmod", nil, "set the mode of pushed files")
+	cmd.Flags().StringArrayVar(&flags.session.syncExclude,
+		"sync-exclude", nil, "exclude files from being pushed")
+	cmd.Flags().StringArrayVar(&flags.session.syncInclude,
+		"sync-include", nil, "include otherwise excluded files")
+	cmd.Flags().StringArrayVar(&flags.session.syncBack,
+		"sync-back", nil, "pull container file changes to a local directory")
 	cmd.Flags().StringArrayVarP(&flags.session.forward,
 		"forward", "p", nil, "forward local ports to container ports")
 	cmd.Flags().StringArrayVarP(&flags.session.listen,
 		"listen", "l", nil, "forward container ports to local ports")
+	cmd.Flags().StringVar(&flags.session.listenImage,
+		"listen-image", "alpine/socat", "image that listens on container ports")
 
 	// Command flags
 	cmd.Flags().BoolVarP(&flags.command.exec,
@@ -239,6 +343,8 @@ func init() {
 		"verbose", "v", false, "output more information")
 	cmd.Flags().BoolVar(&flags.output.debug,
 		"debug", false, "output debug information")
+	cmd.Flags().BoolVar(&flags.output.json,
+		"json", false, "output information as JSON lines")
 
 	// Other flags
 	cmd.Flags().Bool(
@@ -270,7 +376,11 @@ func init() {
 				level = output.LevelDebug
 			}
 		}
-		out = output.NewStdInterface(level, nil, os.Stdout, os.Stderr)
+		if flags.output.json {
+			out = output.NewJSONInterface(level, false, os.Stdout)
+		} else {
+			out = output.NewStdInterface(level, nil, os.Stdout, os.Stderr)
+		}
 	})
 
 	// Do not show usage if there is an error
@@ -338,73 +448,345 @@ func parseKeyValues(flags []string) map[string]*string {
 	return keyValues
 }
 
-func parseSync(flags []string) ([]filesync.Rule, error) {
+// parseSyncRule parses a sync rule in the form [localdir:]remotedir, where
+// a relative local directory is relative to the build context, if any, or
+// otherwise to the current directory, and the local directory may contain
+// a drive letter, so the rule is split at the last ":" character
+func parseSyncRule(rule string, context string) (filesync.Rule, error) {
+	var local, remote string
+	if i := strings.LastIndex(rule, ":"); i >= 0 {
+		local, remote = rule[:i], rule[i+1:]
+	} else {
+		remote = rule
+	}
+	if !path.IsAbs(remote) {
+		return filesync.Rule{}, fmt.Errorf(`invalid sync rule "%s": remote path must be absolute`, rule)
+	}
+	if local == "" {
+		local = "."
+	}
+
+	if context != "" && !filepath.IsAbs(local) {
+		local = filepath.Join(context, local)
+	}
+	local, err := filepath.Abs(local)
+	if err != nil {
+		return filesync.Rule{}, fmt.Errorf(`invalid sync rule "%s": %v`, rule, err)
+	}
+
+	root := local
+	var localPath string
+	if context != "" {
+		rel, err := filepath.Rel(context, local)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			// Directories in the build context share its root
+			root = context
+			if rel != "." {
+				localPath = filepath.ToSlash(rel)
+			}
+		}
+	}
+
+	return filesync.Rule{
+		Root:       root,
+		LocalPath:  localPath,
+		RemotePath: strings.TrimSuffix(remote, "/"),
+	}, nil
+}
+
+func parseSync(flags []string, context string) ([]filesync.Rule, error) {
 	var rules []filesync.Rule
 
-	for _, rule := range flags {
-		localRemote := strings.SplitN(rule, ":", 2)
-		if len(localRemote) == 1 {
-			localRemote = []string{"", localRemote[0]}
-		}
-		if filepath.IsAbs(localRemote[0]) {
-			return nil, fmt.Errorf(`invalid sync rule "%s": local path must be relative to the build context`, rule)
-		} else if !path.IsAbs(localRemote[1]) {
-			return nil, fmt.Errorf(`invalid sync rule "%s": remote path must be absolute`, rule)
-		}
-		if localRemote[0] == "." {
-			localRemote[0] = ""
-		}
-		localRemote[0] = filepath.ToSlash(localRemote[0])
-		localRemote[0] = strings.TrimSuffix(localRemote[0], "/")
-		localRemote[1] = strings.TrimSuffix(localRemote[1], "/")
-		rules = append(rules, filesync.Rule{
-			LocalPath:  localRemote[0],
-			RemotePath: localRemote[1],
-		})
+	for _, flag := range flags {
+		rule, err := parseSyncRule(flag, context)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func parseSyncBack(flags []string, context string) ([]filesync.Rule, error) {
+	var rules []filesync.Rule
+
+	for _, flag := range flags {
+		remoteLocal := strings.SplitN(flag, ":", 2)
+		if len(remoteLocal) == 1 {
+			remoteLocal = append(remoteLocal, "")
+		}
+		if !path.IsAbs(remoteLocal[0]) {
+			return nil, fmt.Errorf(`invalid sync back rule "%s": remote path must be absolute`, flag)
+		}
+		rule, err := parseSyncRule(remoteLocal[1]+":"+remoteLocal[0], context)
+		if err != nil {
+			return nil, err
+		}
+		rule.Pull = true
+		rules = append(rules, rule)
 	}
 
 	return rules, nil
 }
 
+// sameSyncRule indicates if two sync rules map
+// the same local directory to the same remote one
+func sameSyncRule(a filesync.Rule, b filesync.Rule) bool {
+	return a.Root == b.Root && a.LocalPath == b.LocalPath && a.RemotePath == b.RemotePath
+}
+
+func matchSyncRules(rules []filesync.Rule, key string, context string, fn func(rule *filesync.Rule)) error {
+	if key == "*" {
+		for i := range rules {
+			fn(&rules[i])
+		}
+		return nil
+	}
+
+	r, err := parseSyncRule(key, context)
+	if err != nil {
+		return err
+	}
+
+	matched := false
+	for i := range rules {
+		if sameSyncRule(rules[i], r) {
+			fn(&rules[i])
+			matched = true
+		}
+	}
+	if !matched {
+		return fmt.Errorf(`"%s" does not match any sync rule`, key)
+	}
+
+	return nil
+}
+
+// parseSyncRuleValues parses flags in the form [rule=]value, where
+// a value applies to all sync rules unless a rule is specified, and
+// a prefix that is not one of the sync rules is part of the value
+func parseSyncRuleValues(rules []filesync.Rule, flags []string, context string, fn func(rule *filesync.Rule, value string)) error {
+	for _, flag := range flags {
+		key := "*"
+		value := flag
+		if keyValue := strings.SplitN(flag, "=", 2); len(keyValue) == 2 {
+			// Values may themselves contain "=" characters, so only
+			// treat the prefix as a key if it is one of the rules
+			if r, err := parseSyncRule(keyValue[0], context); err == nil {
+				for _, rule := range rules {
+					if sameSyncRule(rule, r) {
+						key = keyValue[0]
+						value = keyValue[1]
+						break
+					}
+				}
+			}
+		}
+		if err := matchSyncRules(rules, key, context, func(rule *filesync.Rule) {
+			fn(rule, value)
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// containerBuild represents an image that is built for another container
+type containerBuild struct {
+	container string
+	dir       string
+	image     string
+}
+
+// parseContainerBuilds parses flags in the form container=dir
+func parseContainerBuilds(flags []string) ([]containerBuild, error) {
+	var builds []containerBuild
+
+	for _, flag := range flags {
+		containerDir := strings.SplitN(flag, "=", 2)
+		if len(containerDir) != 2 || containerDir[0] == "" || containerDir[1] == "" {
+			return nil, fmt.Errorf(`invalid container build "%s"`, flag)
+		}
+		dir, err := filepath.Abs(containerDir[1])
+		if err != nil {
+			return nil, err
+		}
+		builds = append(builds, containerBuild{
+			container: containerDir[0],
+			dir:       dir,
+		})
+	}
+
+	return builds, nil
+}
+
+// parseSteering parses steering flags, which are either endpoints,
+// a percentage of traffic in the form N% or a header in the form
+// name=value, where a percentage and a header may be combined
+func parseSteering(flags []string) (*replacer.Steering, error) {
+	if len(flags) == 0 {
+		return nil, nil
+	}
+
+	steering := &replacer.Steering{}
+	endpoints := false
+	for _, flag := range flags {
+		switch {
+		case flag == "endpoints":
+			endpoints = true
+		case strings.HasSuffix(flag, "%") && steering.Weight == 0:
+			weight, err := strconv.Atoi(strings.TrimSuffix(flag, "%"))
+			if err != nil || weight < 1 || weight > 100 {
+				return nil, fmt.Errorf(`invalid steering weight "%s"`, flag)
+			}
+			steering.Weight = weight
+		case strings.Index(flag, "=") > 0 && steering.Header == "":
+			steering.Header = flag
+		default:
+			return nil, fmt.Errorf(`invalid steering "%s"`, flag)
+		}
+	}
+	if endpoints && (steering.Weight > 0 || steering.Header != "") {
+		return nil, errors.New("cannot steer traffic through endpoints with a weight or header")
+	}
+
+	return steering, nil
+}
+
 var exitCode int
 
+// builder creates the buildctl or docker CLI used by the
+// image builder, or neither if the builder runs in the cluster
+func builder() (buildctl.CLI, docker.CLI, error) {
+	switch flags.build.builder {
+	case "buildkit":
+		return buildctl.NewCLI(
+			flags.build.buildctl.path,
+			&flags.build.buildctl.Options,
+			out, output.LevelVerbose), nil, nil
+	case "docker":
+		return nil, docker.NewCLI(
+			flags.build.docker.path,
+			&flags.build.docker.Options,
+			out, output.LevelVerbose), nil
+	case "kaniko":
+		return nil, nil, nil
+	}
+
+	return nil, nil, fmt.Errorf(`unknown builder "%s"`, flags.build.builder)
+}
+
 func run(cmd *cobra.Command, args []string) error {
-	var k = kubectl.NewCLI(
-		flags.kubectl.path,
-		&flags.kubectl.Options,
-		out, output.LevelVerbose)
+	var k kubectl.CLI
+	if flags.kubectl.native {
+		k = kubectl.NewNative(
+			&flags.kubectl.Options,
+			out, output.LevelVerbose)
+	} else {
+		k = kubectl.NewCLI(
+			flags.kubectl.path,
+			&flags.kubectl.Options,
+			out, output.LevelVerbose)
+	}
+
+	flags.server.NodeSelector = map[string]string{}
+	for k, v := range parseKeyValues(flags.server.nodeSelector) {
+		if v == nil {
+			return fmt.Errorf(`invalid server node selector "%s"`, k)
+		}
+		flags.server.NodeSelector[k] = *v
+	}
+	flags.server.Version = cmd.Version
+	if flags.server.CacheSize <= 0 {
+		return fmt.Errorf("invalid server cache size %d", flags.server.CacheSize)
+	}
+
+	var modes []string
+	for _, mode := range []struct {
+		flag string
+		set  bool
+	}{
+		{"--install", flags.install},
+		{"--uninstall", flags.uninstall},
+		{"--server-status", flags.server.status},
+		{"--server-rollback", flags.server.rollback},
+		{"--doctor", flags.doctor},
+	} {
+		if mode.set {
+			modes = append(modes, mode.flag)
+		}
+	}
+	if len(modes) > 1 {
+		return fmt.Errorf("cannot specify %s flags together", strings.Join(modes, " and "))
+	} else if len(modes) == 1 && len(args) > 0 {
+		return fmt.Errorf("cannot specify command or arguments with %s flag", modes[0])
+	}
 
 	if flags.install {
-		if flags.uninstall {
-			return errors.New("cannot specify --uninstall flag with --install flag")
+		return server.Install(k, &flags.server.Options, out)
+	}
+
+	if flags.server.status {
+		status, err := server.GetStatus(k, &flags.server.Options)
+		if err != nil {
+			return err
 		}
-		if len(args) > 0 {
-			return errors.New("cannot specify command or arguments with --install flag")
+		out.Result(status)
+		return nil
+	}
+
+	if flags.server.rollback {
+		return server.Rollback(k, &flags.server.Options, out)
+	}
+
+	if flags.doctor {
+		bc, d, err := builder()
+		if err != nil {
+			return err
+		}
+		report, err := doctor.Run(k, &flags.server.Options, bc, d, out)
+		if err != nil {
+			return err
+		} else if report.Failed > 0 {
+			return fmt.Errorf("%d of %d checks failed", report.Failed, len(report.Checks))
 		}
-		return server.Install(k, out)
+		return nil
 	}
 
 	if flags.uninstall {
-		if len(args) > 0 {
-			return errors.New("cannot specify command or arguments with --uninstall flag")
-		}
 		if err := pod.DeleteAll(k, true, out); err != nil {
 			return err
 		} else if err = replacer.WaitAll(k, out); err != nil {
 			return err
 		} else if err = replacer.Uninstall(k, out); err != nil {
 			return err
+		} else if err = registry.Uninstall(k, flags.server.Namespace, out); err != nil {
+			return err
 		}
-		return server.Uninstall(k, out)
+		return server.Uninstall(k, &flags.server.Options, out)
 	}
 
 	if flags.config.inherit == "" && flags.replace {
 		return errors.New("cannot specify -R,--replace flag without -c,--inherit flag")
 	}
-	if len(flags.session.sync) > 0 && (len(args) == 0 || !strings.HasPrefix(args[0], ".")) {
-		return errors.New("cannot specify -s,--sync flag without build-dir argument")
+	if !flags.replace && len(flags.steer) > 0 {
+		return errors.New("cannot specify --steer flag without -R,--replace flag")
+	}
+	if len(flags.session.sync) == 0 && (len(flags.session.syncRun) > 0 || len(flags.session.syncRestart) > 0) {
+		return errors.New("cannot specify --sync-run or --sync-restart flags without -s,--sync flag")
+	}
+	if len(flags.session.sync) == 0 && len(flags.session.syncBack) == 0 && flags.session.syncOptions.Agent {
+		return errors.New("cannot specify --sync-agent flag without -s,--sync or --sync-back flag")
+	}
+	if len(flags.session.sync) == 0 && (len(flags.session.syncChown) > 0 || len(flags.session.syncChmod) > 0) {
+		return errors.New("cannot specify --sync-chown or --sync-chmod flags without -s,--sync flag")
+	}
+	if len(flags.session.sync) == 0 && (len(flags.session.syncExclude) > 0 || len(flags.session.syncInclude) > 0) {
+		return errors.New("cannot specify --sync-exclude or --sync-include flags without -s,--sync flag")
 	}
-	if len(flags.session.sync) > 0 || len(flags.session.forward) > 0 || len(flags.session.listen) > 0 {
+	if len(flags.session.sync) > 0 || len(flags.session.syncBack) > 0 || len(flags.session.forward) > 0 || len(flags.session.listen) > 0 {
 		if flags.detach {
 			return errors.New("cannot combine -s,--sync, -p,--forward or -l,--listen flags with -d,--detach flag")
 		}
@@ -412,7 +794,7 @@ func run(cmd *cobra.Command, args []string) error {
 	if !flags.command.exec && len(flags.command.prekill) > 0 {
 		return errors.New("cannot specify -k,--prekill flag without -x,--exec flag")
 	}
-	if flags.command.exec && (len(flags.session.sync) > 0 || len(flags.session.listen) > 0) {
+	if flags.command.exec && (len(flags.session.sync) > 0 || len(flags.session.syncBack) > 0 || len(flags.session.listen) > 0) {
 		return errors.New("cannot combine -s,--sync or -l,--listen flags with -x,--exec flag")
 	}
 	if flags.command.exec && flags.detach {
@@ -439,6 +821,9 @@ func run(cmd *cobra.Command, args []string) error {
 		cmd.Help()
 		return nil
 	}
+	if len(flags.session.syncRestart) > 0 && len(args) < 2 && flags.config.inherit == "" {
+		return errors.New("cannot specify --sync-restart flag without a command, as the command of the image is not known")
+	}
 
 	var image string
 	var buildDir string
@@ -459,9 +844,36 @@ func run(cmd *cobra.Command, args []string) error {
 	}
 	hash = fmt.Sprintf("%s\n%s\n%s", flags.scope, hash, flags.config.inherit)
 	hash = fmt.Sprintf("%x", sha1.Sum([]byte(hash)))[:16]
+	tag := time.Now().UnixNano()
+	imageName := func(repo string) string {
+		name := fmt.Sprintf("%s:%d", repo, tag)
+		switch flags.build.registry {
+		case "":
+			return "dev.local/" + name
+		case registry.Managed:
+			// The image is named once the registry is connected
+			return name
+		default:
+			return strings.TrimSuffix(flags.build.registry, "/") + "/" + name
+		}
+	}
 	if buildDir != "" {
-		image = fmt.Sprintf("dev.local/kdo-%s:%d", hash, time.Now().UnixNano())
+		image = imageName("kdo-" + hash)
+	}
+	containerBuilds, err := parseContainerBuilds(flags.build.containers)
+	if err != nil {
+		return err
+	}
+	for i := range containerBuilds {
+		containerBuilds[i].image = imageName("kdo-" + hash + "-" + containerBuilds[i].container)
 	}
+	// Images for other containers are built with the same options
+	// except for those that are specific to the build directory
+	containerOptions := flags.build.Options
+	containerOptions.File = ""
+	containerOptions.Target = ""
+	containerOptions.Contexts = nil
+	building := buildDir != "" || len(containerBuilds) > 0
 	command := args[1:]
 
 	if flags.delete {
@@ -495,24 +907,56 @@ func run(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	var strategicMerge bool
+	switch flags.config.patchType {
+	default:
+		return fmt.Errorf(`unknown patch type "%s"`, flags.config.patchType)
+	case "merge":
+	case "strategic":
+		strategicMerge = true
+	}
+
+	var digest string
+	var reuse *imagebuild.CacheEntry
+	if buildDir != "" && flags.build.registry == "" && len(containerBuilds) == 0 {
+		if err = out.Do("Checking build context", func() error {
+			var err error
+			digest, err = imagebuild.Digest(buildDir, &flags.build.Options)
+			return err
+		}); err != nil {
+			return err
+		}
+		if cached := imagebuild.Cached(hash); !flags.build.always && !flags.build.NoCache && cached != nil && cached.Digest == digest {
+			if k.Run("get", "node", cached.Node) == nil {
+				reuse = cached
+			}
+		}
+	}
+
+	var bc buildctl.CLI
+	var d docker.CLI
+	if building {
+		if bc, d, err = builder(); err != nil {
+			return err
+		} else if flags.build.builder == "kaniko" && flags.build.registry == "" {
+			return errors.New("cannot specify kaniko builder without --registry flag")
+		}
+	}
+
 	var build func(pod string) error
-	if buildDir != "" {
-		if flags.build.builder == "buildkit" {
-			build = func(pod string) error {
-				bc := buildctl.NewCLI(
-					flags.build.buildctl.path,
-					&flags.build.buildctl.Options,
-					out, output.LevelVerbose)
-				return imagebuild.Build(k, pod, bc, nil, &flags.build.Options, image, buildDir, out)
+	if building && flags.build.registry == "" {
+		build = func(pod string) error {
+			if buildDir != "" {
+				if err := imagebuild.Build(k, pod, &flags.server.Options, bc, d, &flags.build.Options, image, buildDir, out); err != nil {
+					return err
+				}
 			}
-		} else if flags.build.builder == "docker" {
-			build = func(pod string) error {
-				d := docker.NewCLI(
-					flags.build.docker.path,
-					&flags.build.docker.Options,
-					out, output.LevelVerbose)
-				return imagebuild.Build(k, pod, nil, d, &flags.build.Options, image, buildDir, out)
+			for _, b := range containerBuilds {
+				if err := imagebuild.Build(k, pod, &flags.server.Options, bc, d, &containerOptions, b.image, b.dir, out); err != nil {
+					return err
+				}
 			}
+			return nil
 		}
 	}
 
@@ -523,13 +967,140 @@ func run(cmd *cobra.Command, args []string) error {
 		case "deployment", "replicaset", "replicationcontroller", "service", "statefulset":
 		}
 	}
+	steering, err := parseSteering(flags.steer)
+	if err != nil {
+		return err
+	}
+	if steering != nil && (steering.Weight > 0 || steering.Header != "") && flags.config.inheritLabels {
+		// The services would select the pod directly, bypassing its route
+		return errors.New("cannot specify -L,--inherit-labels flag when steering traffic by weight or header")
+	}
 
-	syncRules, err := parseSync(flags.session.sync)
+	syncRules, err := parseSync(flags.session.sync, buildDir)
 	if err != nil {
 		return err
 	}
+	if err = parseSyncRuleValues(syncRules, flags.session.syncRun, buildDir, func(rule *filesync.Rule, value string) {
+		rule.Run = append(rule.Run, value)
+	}); err != nil {
+		return err
+	}
+	if err = parseSyncRuleValues(syncRules, flags.session.syncChown, buildDir, func(rule *filesync.Rule, value string) {
+		rule.Chown = value
+	}); err != nil {
+		return err
+	}
+	if err = parseSyncRuleValues(syncRules, flags.session.syncChmod, buildDir, func(rule *filesync.Rule, value string) {
+		rule.Chmod = value
+	}); err != nil {
+		return err
+	}
+	if err = parseSyncRuleValues(syncRules, flags.session.syncExclude, buildDir, func(rule *filesync.Rule, value string) {
+		rule.Ignore = append(rule.Ignore, value)
+	}); err != nil {
+		return err
+	}
+	if err = parseSyncRuleValues(syncRules, flags.session.syncInclude, buildDir, func(rule *filesync.Rule, value string) {
+		rule.Ignore = append(rule.Ignore, "!"+value)
+	}); err != nil {
+		return err
+	}
+	var restartable bool
+	for _, key := range flags.session.syncRestart {
+		if err = matchSyncRules(syncRules, key, buildDir, func(rule *filesync.Rule) {
+			rule.Restart = true
+			restartable = true
+		}); err != nil {
+			return err
+		}
+	}
+	if restartable {
+		flags.session.syncOptions.Restart = pod.RestartCommand(flags.session.syncOptions.Agent)
+	}
+	syncBackRules, err := parseSyncBack(flags.session.syncBack, buildDir)
+	if err != nil {
+		return err
+	}
+	syncRules = append(syncRules, syncBackRules...)
 
-	p, err := pod.Apply(k, hash, &pod.Config{
+	listenPorts, err := listener.Parse(flags.session.listen)
+	if err != nil {
+		return err
+	}
+
+	pullPolicy := ""
+	if building && flags.build.registry != "" {
+		// Build and push images before the pod is created, so
+		// the pod does not depend on the node it is scheduled on
+		var pushHost, pullHost string
+		stop := func() {}
+		if flags.build.registry == registry.Managed {
+			if flags.build.builder == "kaniko" {
+				if pullHost, err = registry.PullHost(k, flags.server.Namespace, out); err != nil {
+					return err
+				}
+				pushHost = registry.ClusterHost(flags.server.Namespace)
+				flags.build.kaniko.Insecure = true
+			} else if pushHost, pullHost, stop, err = registry.Connect(k, flags.server.Namespace, out); err != nil {
+				return err
+			}
+		}
+		push := func(options *imagebuild.Options, image string, dir string, container string) (string, error) {
+			pushImage := image
+			if pushHost != "" {
+				pushImage = pushHost + "/" + image
+				image = pullHost + "/" + image
+			}
+			var err error
+			if flags.build.builder == "kaniko" {
+				pod := "kdo-build-" + hash
+				if container != "" {
+					if pod += "-" + container; len(pod) > 63 {
+						pod = strings.TrimRight(pod[:63], "-")
+					}
+				}
+				err = imagebuild.BuildInCluster(k, pod, &flags.build.kaniko, options, pushImage, dir, out)
+			} else {
+				err = imagebuild.BuildAndPush(bc, d, options, pushImage, dir, out)
+			}
+			return image, err
+		}
+		if buildDir != "" {
+			image, err = push(&flags.build.Options, image, buildDir, "")
+		}
+		for i := 0; err == nil && i < len(containerBuilds); i++ {
+			containerBuilds[i].image, err = push(&containerOptions, containerBuilds[i].image, containerBuilds[i].dir, containerBuilds[i].container)
+		}
+		stop()
+		if err != nil {
+			return err
+		}
+		pullPolicy = "IfNotPresent"
+	} else if building {
+		pullPolicy = "Never"
+	}
+
+	builtImage := image
+	var rebuild func(pod string) error
+	var nodeName string
+	if reuse != nil {
+		// Skip the build and run on the node that has the image
+		image = reuse.Image
+		nodeName = reuse.Node
+		rebuild, build = build, nil
+	}
+
+	var builtImages []string
+	if buildDir != "" {
+		builtImages = append(builtImages, image)
+	}
+	containerImages := map[string]string{}
+	for _, b := range containerBuilds {
+		containerImages[b.container] = b.image
+		builtImages = append(builtImages, b.image)
+	}
+
+	config := &pod.Config{
 		InheritKind:        inheritKind,
 		InheritName:        inheritName,
 		InheritLabels:      flags.config.inheritLabels,
@@ -538,21 +1109,58 @@ func run(cmd *cobra.Command, args []string) error {
 		Annotations:        parseKeyValues(flags.config.annotations),
 		Spec:               spec,
 		ContainerSpec:      containerSpec,
+		StrategicMerge:     strategicMerge,
 		Container:          container,
 		Image:              image,
 		Env:                parseKeyValues(flags.config.env),
 		NoLifecycle:        flags.config.noLifecycle,
 		NoProbes:           flags.config.noProbes,
 		Replace:            flags.replace,
+		Steering:           steering,
 		Stdin:              flags.command.stdin,
 		TTY:                flags.command.tty,
 		Command:            command,
+		Listen:             listenPorts,
+		ListenImage:        flags.session.listenImage,
+		Restartable:        restartable,
+		SyncAgent:          flags.session.syncOptions.Agent,
+		KeepImages:         flags.build.keep,
+		ImagePullPolicy:    pullPolicy,
+		ContainerImages:    containerImages,
+		BuiltImages:        builtImages,
+		AwaitImage:         flags.build.await,
+		NodeName:           nodeName,
 		Detach:             flags.detach,
-	}, build, out)
+	}
+	p, err := pod.Apply(k, hash, config, build, out)
+	if reuse != nil && pod.IsImageNotPresent(err) {
+		out.Info("Previously built image is no longer present")
+		imagebuild.Forget(hash)
+		image = builtImage
+		build = rebuild
+		config.Image = image
+		config.BuiltImages = []string{image}
+		config.NodeName = ""
+		p, err = pod.Apply(k, hash, config, build, out)
+	}
 	if err != nil {
 		return err
 	}
 
+	if build != nil && digest != "" {
+		node, err := p.Node()
+		if err == nil {
+			err = imagebuild.Remember(hash, &imagebuild.CacheEntry{
+				Digest: digest,
+				Image:  image,
+				Node:   node,
+			})
+		}
+		if err != nil {
+			out.Debug("failed to remember built image: %v", err)
+		}
+	}
+
 	if flags.detach {
 		return nil
 	}
@@ -560,9 +1168,11 @@ func run(cmd *cobra.Command, args []string) error {
 	defer pod.Delete(k, hash, out)
 
 	if len(syncRules) > 0 {
-		if err = filesync.Start(buildDir, syncRules, k, p.Pod, p.Container, out); err != nil {
+		syncSession, err := filesync.Start(syncRules, &flags.session.syncOptions, k, p.Pod, p.Container, out)
+		if err != nil {
 			return err
 		}
+		defer syncSession.Report()
 	}
 
 	if len(flags.session.forward) > 0 {
@@ -576,9 +1186,16 @@ func run(cmd *cobra.Command, args []string) error {
 		defer stop()
 	}
 
-	// TODO
-	// if len(flags.session.listen) > 0 {
-	// }
+	if len(listenPorts) > 0 {
+		op := out.Start("Listening on ports")
+		stop, err := listener.Start(k, p.Pod, listenPorts, out)
+		if err != nil {
+			op.Failed()
+			return err
+		}
+		op.Done()
+		defer stop()
+	}
 
 	var cmdArgs []string
 	if flags.command.stdin && !p.Exited() {
@@ -609,7 +1226,7 @@ func main() {
 	}
 	if err != nil {
 		exitCode := 1
-		if exitErr, ok := err.(*exec.ExitError); !ok {
+		if exitErr, ok := err.(interface{ ExitCode() int }); !ok {
 			fmt.Fprintf(os.Stderr, "Error: %s\n", strings.TrimRight(err.Error(), "\r\n"))
 		} else {
 			exitCode = exitErr.ExitCode()
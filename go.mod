@@ -3,11 +3,20 @@ module github.com/stepro/kdo
 go 1.12
 
 require (
+	github.com/fsnotify/fsnotify v1.6.0
 	github.com/ghodss/yaml v1.0.0
 	github.com/moby/buildkit v0.12.5
 	github.com/moby/patternmatcher v0.6.0
-	github.com/spf13/cobra v1.6.1
-	golang.org/x/sys v0.7.0
+	github.com/spf13/cobra v1.7.0
+	golang.org/x/sys v0.18.0
+	google.golang.org/grpc v1.56.3
+	k8s.io/api v0.28.15
+	k8s.io/apimachinery v0.28.15
+	k8s.io/cli-runtime v0.28.15
+	k8s.io/client-go v0.28.15
+	k8s.io/cri-api v0.27.1
+	k8s.io/klog/v2 v2.100.1
+	k8s.io/kubectl v0.28.15
 )
 
 replace github.com/Sirupsen/logrus => github.com/sirupsen/logrus v1.6.0
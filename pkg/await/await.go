@@ -0,0 +1,97 @@
+package await
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func pkgerror(err error) error {
+	if err != nil {
+		err = fmt.Errorf("await: %v", err)
+	}
+	return err
+}
+
+// Runtime represents the image store of a container runtime
+type Runtime interface {
+	// Has indicates if an image is present
+	Has(image string) (bool, error)
+	// Tags gets the tags of the images in a repository
+	Tags(repo string) ([]string, error)
+	// Remove removes an image
+	Remove(image string) error
+	// Close releases any resources held by the runtime
+	Close() error
+}
+
+// Sockets are the paths of the sockets of the supported
+// container runtimes, in the order they are detected
+var Sockets = struct {
+	Containerd string
+	Docker     string
+}{
+	Containerd: "/run/containerd/containerd.sock",
+	Docker:     "/run/docker.sock",
+}
+
+// Detect detects the container runtime of the node
+// from the sockets that are mounted in the container
+func Detect() (Runtime, error) {
+	if isSocket(Sockets.Containerd) {
+		r, err := newCRI(Sockets.Containerd)
+		return r, pkgerror(err)
+	} else if isSocket(Sockets.Docker) {
+		return newDocker(Sockets.Docker), nil
+	}
+
+	return nil, pkgerror(fmt.Errorf("cannot find %s or %s", Sockets.Containerd, Sockets.Docker))
+}
+
+func isSocket(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && info.Mode()&os.ModeSocket != 0
+}
+
+// Wait waits for a set of images to be present
+func Wait(r Runtime, images []string, interval time.Duration) error {
+	for _, image := range images {
+		for {
+			has, err := r.Has(image)
+			if err != nil {
+				return pkgerror(err)
+			} else if has {
+				break
+			}
+			time.Sleep(interval)
+		}
+	}
+
+	return nil
+}
+
+// Prune removes all but the most recent images in the repositories
+// of a set of images, where images are tagged with a timestamp
+func Prune(r Runtime, images []string, keep int) error {
+	for _, image := range images {
+		repo := image[:strings.LastIndex(image, ":")]
+		tags, err := r.Tags(repo)
+		if err != nil {
+			return pkgerror(err)
+		}
+		sort.Slice(tags, func(i, j int) bool {
+			a, _ := strconv.ParseInt(tags[i], 10, 64)
+			b, _ := strconv.ParseInt(tags[j], 10, 64)
+			return a > b
+		})
+		for i := keep; i < len(tags); i++ {
+			// Failures are tolerated, as images may be in use
+			r.Remove(repo + ":" + tags[i])
+		}
+	}
+
+	return nil
+}
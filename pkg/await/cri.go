@@ -0,0 +1,83 @@
+package await
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// cri accesses images through the CRI image service
+type cri struct {
+	conn *grpc.ClientConn
+	c    runtime.ImageServiceClient
+}
+
+func newCRI(socket string) (*cri, error) {
+	conn, err := grpc.Dial("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+
+	return &cri{
+		conn: conn,
+		c:    runtime.NewImageServiceClient(conn),
+	}, nil
+}
+
+func (r *cri) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 10*time.Second)
+}
+
+func (r *cri) Has(image string) (bool, error) {
+	ctx, cancel := r.context()
+	defer cancel()
+
+	res, err := r.c.ImageStatus(ctx, &runtime.ImageStatusRequest{
+		Image: &runtime.ImageSpec{Image: image},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return res.Image != nil, nil
+}
+
+func (r *cri) Tags(repo string) ([]string, error) {
+	ctx, cancel := r.context()
+	defer cancel()
+
+	res, err := r.c.ListImages(ctx, &runtime.ListImagesRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []string
+	for _, image := range res.Images {
+		for _, repoTag := range image.RepoTags {
+			if strings.HasPrefix(repoTag, repo+":") {
+				tags = append(tags, repoTag[len(repo)+1:])
+			}
+		}
+	}
+
+	return tags, nil
+}
+
+func (r *cri) Remove(image string) error {
+	ctx, cancel := r.context()
+	defer cancel()
+
+	_, err := r.c.RemoveImage(ctx, &runtime.RemoveImageRequest{
+		Image: &runtime.ImageSpec{Image: image},
+	})
+
+	return err
+}
+
+func (r *cri) Close() error {
+	return r.conn.Close()
+}
@@ -0,0 +1,116 @@
+package await
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// docker accesses images through the Docker Engine API
+type docker struct {
+	client *http.Client
+}
+
+func newDocker(socket string) *docker {
+	return &docker{
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+func (r *docker) do(method string, path string, query url.Values) (*http.Response, error) {
+	u := url.URL{
+		Scheme:   "http",
+		Host:     "docker",
+		Path:     path,
+		RawQuery: query.Encode(),
+	}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.client.Do(req)
+}
+
+func (r *docker) Has(image string) (bool, error) {
+	res, err := r.do("GET", "/images/"+image+"/json", nil)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+
+	return false, fmt.Errorf("docker: unexpected status %s", res.Status)
+}
+
+func (r *docker) Tags(repo string) ([]string, error) {
+	filters, err := json.Marshal(map[string][]string{
+		"reference": {repo},
+	})
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.do("GET", "/images/json", url.Values{"filters": {string(filters)}})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("docker: unexpected status %s", res.Status)
+	}
+
+	var images []struct {
+		RepoTags []string
+	}
+	if err = json.NewDecoder(res.Body).Decode(&images); err != nil {
+		return nil, err
+	}
+
+	var tags []string
+	for _, image := range images {
+		for _, repoTag := range image.RepoTags {
+			if strings.HasPrefix(repoTag, repo+":") {
+				tags = append(tags, repoTag[len(repo)+1:])
+			}
+		}
+	}
+
+	return tags, nil
+}
+
+func (r *docker) Remove(image string) error {
+	res, err := r.do("DELETE", "/images/"+image, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("docker: unexpected status %s", res.Status)
+	}
+
+	return nil
+}
+
+func (r *docker) Close() error {
+	return nil
+}
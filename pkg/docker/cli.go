@@ -18,6 +18,9 @@ type CLI interface {
 	// EachLine runs a docker command that sends
 	// its lines of standard output to a callback
 	EachLine(args []string, fn func(line string)) error
+	// EachErrLine runs a docker command that sends
+	// its lines of standard error to a callback
+	EachErrLine(args []string, fn func(line string)) error
 }
 
 type cli struct {
@@ -46,6 +49,13 @@ func (d *cli) EachLine(args []string, fn func(line string)) error {
 	return command.EachLine(d.command(args...), d.out, d.verb, fn)
 }
 
+func (d *cli) EachErrLine(args []string, fn func(line string)) error {
+	cmd := d.command(args...)
+	cmd.Stderr = output.NewLineWriter(fn)
+
+	return command.Run(cmd, d.out, d.verb)
+}
+
 // NewCLI creates a new docker CLI object
 func NewCLI(path string, options *Options, out *output.Interface, verb output.Level) CLI {
 	return &cli{
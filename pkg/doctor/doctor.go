@@ -0,0 +1,457 @@
+package doctor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/stepro/kdo/pkg/buildctl"
+	"github.com/stepro/kdo/pkg/docker"
+	"github.com/stepro/kdo/pkg/kubectl"
+	"github.com/stepro/kdo/pkg/output"
+	"github.com/stepro/kdo/pkg/portforward"
+	"github.com/stepro/kdo/pkg/registry"
+	"github.com/stepro/kdo/pkg/replacer"
+	"github.com/stepro/kdo/pkg/server"
+)
+
+func pkgerror(err error) error {
+	if err != nil {
+		err = fmt.Errorf("doctor: %v", err)
+	}
+	return err
+}
+
+// Check represents the result of a diagnostic check
+type Check struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Report represents the results of a set of diagnostic checks
+type Report struct {
+	Kind   string  `json:"kind"`
+	Checks []Check `json:"checks"`
+	Failed int     `json:"failed"`
+}
+
+func (r *Report) add(name string, passed bool, format string, v ...interface{}) {
+	r.Checks = append(r.Checks, Check{
+		Name:   name,
+		Passed: passed,
+		Detail: fmt.Sprintf(format, v...),
+	})
+	if !passed {
+		r.Failed++
+	}
+}
+
+// permission represents a permission required by kdo
+type permission struct {
+	verb        string
+	resource    string
+	subresource string
+	// server indicates the permission is required
+	// in the namespace of the server components
+	server bool
+	// needed describes what requires the permission
+	needed string
+	// when restricts the server component options
+	// for which the permission is required
+	when func(options *server.Options) bool
+}
+
+func daemonSet(options *server.Options) bool {
+	return !options.OnDemand
+}
+
+func onDemand(options *server.Options) bool {
+	return options.OnDemand
+}
+
+// permissions are the permissions required to run kdo pods,
+// replace workloads and install server components
+var permissions = []permission{
+	{verb: "create", resource: "pods", needed: "kdo pods"},
+	{verb: "get", resource: "pods", needed: "kdo pods"},
+	{verb: "patch", resource: "pods", needed: "kdo pods"},
+	{verb: "list", resource: "pods", needed: "kdo pods"},
+	{verb: "delete", resource: "pods", needed: "kdo pods"},
+	{verb: "create", resource: "pods", subresource: "attach", needed: "kdo pods"},
+	{verb: "create", resource: "pods", subresource: "exec", needed: "kdo pods"},
+	{verb: "create", resource: "pods", subresource: "portforward", needed: "kdo pods"},
+	{verb: "get", resource: "services", needed: "kdo pods"},
+	{verb: "create", resource: "serviceaccounts", needed: "replacing workloads"},
+	{verb: "create", resource: "roles.rbac.authorization.k8s.io", needed: "replacing workloads"},
+	{verb: "create", resource: "rolebindings.rbac.authorization.k8s.io", needed: "replacing workloads"},
+	{verb: "create", resource: "jobs.batch", needed: "replacing workloads"},
+	{verb: "create", resource: "endpointslices.discovery.k8s.io", needed: "steering traffic"},
+	{verb: "create", resource: "services", needed: "steering traffic"},
+	{verb: "create", resource: "virtualservices.networking.istio.io", needed: "steering traffic"},
+	{verb: "create", resource: "configmaps", server: true, needed: "server components"},
+	{verb: "create", resource: "daemonsets.apps", server: true, needed: "server components", when: daemonSet},
+	{verb: "create", resource: "pods", server: true, needed: "server components", when: onDemand},
+	{verb: "create", resource: "pods", subresource: "portforward", server: true, needed: "building images"},
+}
+
+// replacerPermissions gets the permissions granted by the role
+// that replacers run with, which a user creating the role must
+// also be granted, as roles cannot escalate permissions
+func replacerPermissions() ([]permission, error) {
+	rules, err := replacer.RoleRules()
+	if err != nil {
+		return nil, err
+	}
+
+	var permissions []permission
+	for _, rule := range rules {
+		for _, group := range rule.APIGroups {
+			for _, resource := range rule.Resources {
+				resourceSubresource := strings.SplitN(resource, "/", 2)
+				for _, verb := range rule.Verbs {
+					p := permission{
+						verb:     verb,
+						resource: resourceSubresource[0],
+						needed:   "replacing workloads",
+					}
+					if group != "" {
+						p.resource += "." + group
+					}
+					if len(resourceSubresource) == 2 {
+						p.subresource = resourceSubresource[1]
+					}
+					permissions = append(permissions, p)
+				}
+			}
+		}
+	}
+
+	return permissions, nil
+}
+
+// runtimeScript detects the container runtime of a
+// node in the same way as the server components do
+const runtimeScript = `if [ -e /run/containerd/containerd.sock ]; then echo containerd; elif [ -e /run/docker.sock ]; then echo docker; fi`
+
+// Run runs diagnostic checks against a cluster and reports
+// their results as a table, using the builder implied by
+// the buildctl or docker CLI, if any, to reach the nodes
+func Run(k kubectl.CLI, options *server.Options, bc buildctl.CLI, d docker.CLI, out *output.Interface) (*Report, error) {
+	report := &Report{
+		Kind:   "doctorReport",
+		Checks: []Check{},
+	}
+
+	if err := out.Do("Running diagnostics", func(op output.Operation) error {
+		op.Progress("checking kubectl")
+		if !checkVersion(k, report) {
+			// Nothing else can be checked without a cluster
+			return nil
+		}
+
+		op.Progress("checking permissions")
+		replacing, err := replacerPermissions()
+		if err != nil {
+			return err
+		}
+		for _, p := range append(append([]permission{}, permissions...), replacing...) {
+			if p.when != nil && !p.when(options) {
+				continue
+			}
+			checkPermission(k, options, p, report)
+		}
+
+		op.Progress("checking nodes")
+		checkNodes(k, options, bc, d, op, report)
+
+		op.Progress("checking registry")
+		checkRegistry(k, options, report)
+		return nil
+	}); err != nil {
+		return nil, pkgerror(err)
+	}
+
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tRESULT\tDETAIL")
+	for _, check := range report.Checks {
+		result := "pass"
+		if !check.Passed {
+			result = "FAIL"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", check.Name, result, check.Detail)
+	}
+	w.Flush()
+	for _, line := range strings.Split(strings.TrimRight(buf.String(), "\n"), "\n") {
+		out.Info("%s", line)
+	}
+	out.Object(output.LevelVerbose, report)
+
+	return report, nil
+}
+
+// checkVersion checks that the cluster is reachable
+// and reports the versions of kubectl and the cluster
+func checkVersion(k kubectl.CLI, report *Report) bool {
+	s, err := k.String("version", "--output", "json")
+	if err != nil {
+		report.add("kubectl", false, "%s", strings.TrimSpace(err.Error()))
+		return false
+	}
+
+	var versions struct {
+		ClientVersion *struct {
+			GitVersion string `json:"gitVersion"`
+		} `json:"clientVersion"`
+		ServerVersion *struct {
+			GitVersion string `json:"gitVersion"`
+		} `json:"serverVersion"`
+	}
+	if err = json.Unmarshal([]byte(s), &versions); err != nil {
+		report.add("kubectl", false, "%v", err)
+		return false
+	} else if versions.ServerVersion == nil {
+		report.add("kubectl", false, "cannot connect to the cluster")
+		return false
+	}
+
+	client := "unknown"
+	if versions.ClientVersion != nil {
+		client = versions.ClientVersion.GitVersion
+	}
+	report.add("kubectl", true, "client %s, server %s", client, versions.ServerVersion.GitVersion)
+	return true
+}
+
+// checkPermission checks that a permission is granted
+func checkPermission(k kubectl.CLI, options *server.Options, p permission, report *Report) {
+	var args []string
+	if p.server {
+		args = append(args, "--namespace", options.Namespace)
+	}
+	args = append(args, "auth", "can-i", p.verb, p.resource)
+	if p.subresource != "" {
+		args = append(args, "--subresource", p.subresource)
+	}
+
+	name := "can " + p.verb + " " + p.resource
+	if p.subresource != "" {
+		name += "/" + p.subresource
+	}
+	if p.server {
+		name += " in " + options.Namespace
+	}
+
+	// The command fails without an error message when denied,
+	// but may warn about resources the server does not have
+	s, err := k.ErrorString(args...)
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "Warning:") {
+			lines = append(lines, line)
+		}
+	}
+	if err == nil {
+		report.add(name, true, "")
+	} else if s = strings.Join(lines, " "); s == "" {
+		report.add(name, false, "denied, but needed for %s", p.needed)
+	} else {
+		report.add(name, false, "%s", s)
+	}
+}
+
+// checkNodes checks the container runtime of each node, as reported
+// by the node and detected by its server component, if running, and
+// that the builder in the server component is reachable
+func checkNodes(k kubectl.CLI, options *server.Options, bc buildctl.CLI, d docker.CLI, op output.Operation, report *Report) {
+	nodes, err := k.Lines("get", "nodes", "--selector", "kubernetes.io/os=linux",
+		"--output", "go-template={{range .items}}{{.metadata.name}} {{.status.nodeInfo.containerRuntimeVersion}}\n{{end}}")
+	if err != nil {
+		report.add("nodes", false, "%s", strings.TrimSpace(err.Error()))
+		return
+	} else if len(nodes) == 0 {
+		report.add("nodes", false, "no linux nodes")
+		return
+	}
+
+	status, err := server.GetStatus(k, options)
+	if err != nil {
+		report.add("server components", false, "%s", strings.TrimSpace(err.Error()))
+		return
+	}
+	nodePods := map[string]server.NodeStatus{}
+	stale := 0
+	for _, node := range status.Nodes {
+		nodePods[node.Node] = node
+		if !node.Current {
+			stale++
+		}
+	}
+	switch {
+	case len(status.Nodes) == 0:
+		report.add("server components", true, "not running, started when first needed")
+	case stale > 0:
+		report.add("server components", false, "%d of %d are not up to date with version %s", stale, len(status.Nodes), status.Version)
+	default:
+		report.add("server components", true, "version %s on %d nodes", status.Version, len(status.Nodes))
+	}
+
+	for _, line := range nodes {
+		nameRuntime := strings.SplitN(line, " ", 2)
+		node, runtime := nameRuntime[0], ""
+		if len(nameRuntime) == 2 {
+			runtime = strings.SplitN(nameRuntime[1], "://", 2)[0]
+		}
+		pod := nodePods[node]
+
+		op.Progress("checking node %s", node)
+		detected := ""
+		if pod.Ready {
+			if detected, err = k.String("--namespace", options.Namespace, "exec", pod.Pod, "--", "sh", "-c", runtimeScript); err != nil {
+				report.add("runtime on "+node, false, "%s", strings.TrimSpace(err.Error()))
+				continue
+			}
+			detected = strings.TrimSpace(detected)
+		}
+		switch {
+		case pod.Ready && detected == "":
+			report.add("runtime on "+node, false, "server component cannot find a containerd or docker socket")
+			continue
+		case detected != "" && detected != runtime:
+			report.add("runtime on "+node, false, "node uses %s but server component uses %s", runtime, detected)
+			continue
+		case runtime != "containerd" && runtime != "docker":
+			report.add("runtime on "+node, false, "%s is not supported", runtime)
+			continue
+		case bc != nil && runtime != "containerd":
+			report.add("runtime on "+node, false, "%s requires the docker builder", runtime)
+			continue
+		case d != nil && runtime != "docker":
+			report.add("runtime on "+node, false, "%s requires the buildkit builder", runtime)
+			continue
+		}
+		report.add("runtime on "+node, true, "%s", runtime)
+
+		if pod.Ready && (bc != nil || d != nil) {
+			checkBuilder(k, options, node, pod.Pod, bc, d, report)
+		}
+	}
+}
+
+// registryScript reports whether the managed registry can be
+// reached on the loopback interface of a node at a node port
+const registryScript = `if wget -q -O /dev/null "http://localhost:$1/v2/"; then echo reachable; else echo unreachable; fi`
+
+// registryTimeout is how long the registry check
+// waits for the pod that runs it to complete
+const registryTimeout = 2 * time.Minute
+
+// checkRegistry checks that a node can reach the managed registry,
+// if installed, on the loopback interface as its container runtime
+// does when pulling images, which requires the node to route loopback
+// traffic to node ports using the net.ipv4.conf.all.route_localnet
+// setting, as kube-proxy configures it in iptables mode
+func checkRegistry(k kubectl.CLI, options *server.Options, report *Report) {
+	nodePort, err := registry.NodePort(k, options.Namespace)
+	if err != nil {
+		report.add("registry", false, "%s", strings.TrimSpace(err.Error()))
+		return
+	} else if nodePort == "" {
+		report.add("registry", true, "not installed, installed when first needed")
+		return
+	}
+
+	pod := fmt.Sprintf("kdo-doctor-%d", time.Now().Unix())
+	overrides, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"hostNetwork": true,
+			"nodeSelector": map[string]string{
+				"kubernetes.io/os": "linux",
+			},
+			"containers": []map[string]interface{}{{
+				"name":    pod,
+				"command": []string{"sh", "-c", registryScript, "sh", nodePort},
+			}},
+		},
+	})
+	if err != nil {
+		report.add("registry", false, "%v", err)
+		return
+	}
+
+	if err = k.Run("--namespace", options.Namespace, "run", pod, "--image", options.Image,
+		"--restart", "Never", "--quiet", "--overrides", string(overrides)); err != nil {
+		report.add("registry", false, "cannot create a pod to reach the registry from a node: %s", strings.TrimSpace(err.Error()))
+		return
+	}
+	defer k.Run("--namespace", options.Namespace, "delete", "pod", pod, "--ignore-not-found", "--wait=false")
+
+	for deadline := time.Now().Add(registryTimeout); ; time.Sleep(1 * time.Second) {
+		status, err := k.String("--namespace", options.Namespace, "get", "pod", pod, "--output",
+			"go-template={{.status.phase}}|{{range .status.containerStatuses}}{{with .state.waiting}}{{.reason}}: {{.message}}{{end}}{{end}}")
+		if err != nil {
+			report.add("registry", false, "%s", strings.TrimSpace(err.Error()))
+			return
+		}
+		phaseWaiting := strings.SplitN(strings.TrimSpace(status), "|", 2)
+		phase, waiting := phaseWaiting[0], ""
+		if len(phaseWaiting) == 2 {
+			waiting = phaseWaiting[1]
+		}
+		if phase == "Succeeded" || phase == "Failed" {
+			break
+		} else if strings.Contains(waiting, "ImagePull") || strings.HasPrefix(waiting, "InvalidImageName") {
+			report.add("registry", false, "cannot pull image %s to reach the registry from a node: %s", options.Image, waiting)
+			return
+		} else if time.Now().After(deadline) {
+			report.add("registry", false, "pod to reach the registry from a node did not complete within %v", registryTimeout)
+			return
+		}
+	}
+
+	result, err := k.String("--namespace", options.Namespace, "logs", pod)
+	switch result = strings.TrimSpace(result); {
+	case err != nil:
+		report.add("registry", false, "%s", strings.TrimSpace(err.Error()))
+	case result == "reachable":
+		report.add("registry", true, "reachable from nodes at localhost:%s", nodePort)
+	case result == "unreachable":
+		report.add("registry", false, "cannot reach localhost:%s from a node, which requires net.ipv4.conf.all.route_localnet", nodePort)
+	default:
+		report.add("registry", false, "pod to reach the registry from a node failed: %s", result)
+	}
+}
+
+// checkBuilder checks that the builder in a server
+// component is reachable through a port forward
+func checkBuilder(k kubectl.CLI, options *server.Options, node string, pod string, bc buildctl.CLI, d docker.CLI, report *Report) {
+	name := "builder on " + node
+	port, stop, err := portforward.StartOne(k, options.Namespace, pod, "2375")
+	if err != nil {
+		report.add(name, false, "%s", strings.TrimSpace(err.Error()))
+		return
+	}
+	defer stop()
+
+	if bc != nil {
+		if err = bc.EachErrLine([]string{"--addr", "tcp://localhost:" + port, "debug", "workers"}, func(line string) {}); err != nil {
+			report.add(name, false, "%s", strings.TrimSpace(err.Error()))
+		} else {
+			report.add(name, true, "buildkitd is reachable")
+		}
+		return
+	}
+
+	var version string
+	if err = d.EachLine([]string{"--host", "localhost:" + port, "version", "--format", "{{.Server.Version}}"}, func(line string) {
+		version = line
+	}); err != nil {
+		report.add(name, false, "%s", strings.TrimSpace(err.Error()))
+	} else {
+		report.add(name, true, "docker %s is reachable", version)
+	}
+}
@@ -0,0 +1,80 @@
+package filesync
+
+// AgentPath is the directory in which the sync agent,
+// a static busybox binary and links for its applets,
+// is installed in a container that has no tools of its own
+const AgentPath = "/kdo-sync"
+
+// AgentShell is the shell provided by the sync agent
+const AgentShell = AgentPath + "/sh"
+
+const agentVolume = "kdo-sync-agent"
+
+const agentImage = "busybox:musl"
+
+// installScript copies the busybox binary into
+// the agent volume and links all of its applets
+const installScript = `set -e
+cp /bin/busybox ` + AgentPath + `/busybox
+for applet in $(/bin/busybox --list); do
+  [ "$applet" = busybox ] || ln -sf busybox ` + AgentPath + `/$applet
+done
+`
+
+// agentPath prefixes scripts so that tools that are missing
+// from the container are found in the agent directory instead
+const agentPath = `export PATH="${PATH:+$PATH:}` + AgentPath + `"
+`
+
+// AgentVolume gets the specification of
+// the volume that holds the sync agent
+func AgentVolume() map[string]interface{} {
+	return map[string]interface{}{
+		"name":     agentVolume,
+		"emptyDir": map[string]interface{}{},
+	}
+}
+
+// AgentVolumeMount gets the specification of the volume
+// mount that exposes the sync agent to a container
+func AgentVolumeMount() map[string]interface{} {
+	return map[string]interface{}{
+		"name":      agentVolume,
+		"mountPath": AgentPath,
+	}
+}
+
+// AgentInitContainer gets the specification of an
+// init container that installs the sync agent
+func AgentInitContainer() map[string]interface{} {
+	return map[string]interface{}{
+		"name":         "kdo-install-sync-agent",
+		"image":        agentImage,
+		"command":      []string{"/bin/sh", "-c", installScript},
+		"volumeMounts": []map[string]interface{}{AgentVolumeMount()},
+	}
+}
+
+// command gets a command line that runs a tool in the container
+func (o *Options) command(name string, arg ...string) []string {
+	if o.Agent {
+		name = AgentPath + "/" + name
+	}
+	return append([]string{name}, arg...)
+}
+
+// ShellCommand gets a command line that runs a shell script in
+// a container, optionally using the shell of the sync agent
+func ShellCommand(agent bool, script string, arg ...string) []string {
+	shell := "/bin/sh"
+	if agent {
+		shell = AgentShell
+		script = agentPath + script
+	}
+	return append([]string{shell, "-c", script, "sh"}, arg...)
+}
+
+// script gets a command line that runs a shell script in the container
+func (o *Options) script(script string, arg ...string) []string {
+	return ShellCommand(o.Agent, script, arg...)
+}
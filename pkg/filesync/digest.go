@@ -0,0 +1,173 @@
+package filesync
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/stepro/kdo/pkg/kubectl"
+)
+
+// digestDir is the digest recorded for a directory
+const digestDir = "dir"
+
+// digestLink prefixes the target of a symbolic
+// link to form the digest recorded for the link
+const digestLink = "link:"
+
+// digestScript outputs the digests of all files and directories
+// under a set of remote directories, in the sha256sum format
+const digestScript = `for d; do
+  [ -d "$d" ] || continue
+  find "$d" -type d -exec printf '` + digestDir + `  %s\n' {} +
+  find "$d" -type f -exec sha256sum {} +
+  find "$d" -type l -exec sh -c 'for f; do printf "` + digestLink + `%s  %s\n" "$(readlink "$f")" "$f"; done' sh {} +
+done
+`
+
+type localDigest struct {
+	mod    time.Time
+	size   int64
+	digest string
+}
+
+// manifest tracks the content digests of
+// synchronized files on both sides of a rule
+type manifest struct {
+	root   string
+	sync   []Rule
+	local  map[string]localDigest
+	remote map[string]string
+}
+
+func newManifest(root string, sync []Rule, options *Options, k kubectl.CLI, pod string, container string) (*manifest, error) {
+	m := &manifest{
+		root:   root,
+		sync:   sync,
+		local:  map[string]localDigest{},
+		remote: map[string]string{},
+	}
+
+	args := append([]string{"exec", pod, "--container", container, "--"}, options.script(digestScript)...)
+	for _, rule := range sync {
+		args = append(args, rule.RemotePath)
+	}
+	lines, err := k.Lines(args...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot determine remote file digests: %v", err)
+	}
+	for _, line := range lines {
+		digestPath := strings.SplitN(line, "  ", 2)
+		if len(digestPath) == 2 {
+			m.remote[digestPath[1]] = digestPath[0]
+		}
+	}
+
+	return m, nil
+}
+
+func (m *manifest) digest(path string) (string, error) {
+	if strings.HasSuffix(path, "/") {
+		return digestDir, nil
+	}
+
+	name := filepath.Join(m.root, path)
+	info, err := os.Lstat(name)
+	if err != nil {
+		return "", err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(name)
+		if err != nil {
+			return "", err
+		}
+		return digestLink + filepath.ToSlash(target), nil
+	}
+
+	if d, ok := m.local[path]; ok && d.mod.Equal(info.ModTime()) && d.size == info.Size() {
+		return d.digest, nil
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, file); err != nil {
+		return "", err
+	}
+
+	d := localDigest{
+		mod:    info.ModTime(),
+		size:   info.Size(),
+		digest: fmt.Sprintf("%x", h.Sum(nil)),
+	}
+	m.local[path] = d
+
+	return d.digest, nil
+}
+
+func remotePaths(sync []Rule, path string) []string {
+	var paths []string
+	for _, rule := range sync {
+		if rule.matches(path) {
+			paths = append(paths, rule.remotePath(path))
+		}
+	}
+	return paths
+}
+
+// differ filters a set of paths to those whose
+// content differs from the remote content
+func (m *manifest) differ(paths []string) []string {
+	var result []string
+	for _, path := range paths {
+		digest, err := m.digest(path)
+		if err != nil {
+			// Let the transfer report the problem
+			result = append(result, path)
+			continue
+		}
+		for _, remotePath := range remotePaths(m.sync, path) {
+			if m.remote[remotePath] != digest {
+				result = append(result, path)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// pushed records that a set of paths were transferred
+func (m *manifest) pushed(paths []string) {
+	for _, path := range paths {
+		digest, err := m.digest(path)
+		if err != nil {
+			continue
+		}
+		for _, remotePath := range remotePaths(m.sync, path) {
+			m.remote[remotePath] = digest
+		}
+	}
+}
+
+// deleted records that a set of paths were deleted
+func (m *manifest) deleted(paths []string) {
+	for _, path := range paths {
+		delete(m.local, path)
+		for _, remotePath := range remotePaths(m.sync, path) {
+			for p := range m.remote {
+				if p == remotePath || strings.HasPrefix(p, remotePath+"/") {
+					delete(m.remote, p)
+				}
+			}
+		}
+	}
+}
@@ -2,8 +2,13 @@ package filesync
 
 import (
 	"fmt"
+	"path"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/moby/patternmatcher"
 	"github.com/stepro/kdo/pkg/kubectl"
 	"github.com/stepro/kdo/pkg/output"
 )
@@ -17,47 +22,288 @@ func pkgerror(err error) error {
 
 // Rule represents a file synchronization rule
 type Rule struct {
+	// Root is the absolute path of the local directory
+	// that contains the local path of the rule
+	Root       string
 	LocalPath  string
 	RemotePath string
+	// Run is a set of commands that are run in the remote
+	// directory after changes are successfully pushed
+	Run []string
+	// Restart indicates if the main process in the container
+	// should be restarted after changes are successfully pushed
+	Restart bool
+	// Pull indicates that changes are instead pulled
+	// from the remote directory to the local directory
+	Pull bool
+	// Chown is the owner, in the form user[:group], that
+	// pushed files are given in the remote directory
+	Chown string
+	// Chmod is the mode that pushed regular files, excluding
+	// directories and symbolic links, are given in the remote
+	// directory
+	Chmod string
+	// Ignore is a set of patterns in the .dockerignore format
+	// that are applied after those in the ignore file, which
+	// exclude paths or, when prefixed with !, include them
+	Ignore []string
+	pm     *patternmatcher.PatternMatcher
 }
 
-// Start starts synchronizing files from a directory to a container in a pod
-func Start(dir string, sync []Rule, k kubectl.CLI, pod string, container string, out *output.Interface) error {
-	return pkgerror(start(dir, func(added []string, updated []string, deleted []string) {
-		if len(deleted) > 0 {
-			execArgs := []string{"exec", pod, "--container", container, "--", "rm", "-rf"}
-			for _, path := range deleted {
-				for _, rule := range sync {
-					if rule.LocalPath == "" || strings.HasPrefix(path, rule.LocalPath+"/") {
-						execArgs = append(execArgs, rule.RemotePath+"/"+path)
-					}
-				}
-			}
-			if err := k.Run(execArgs...); err != nil {
-				out.Debug("failed to synchronize deleted files: %v", err)
-			} else {
-				for _, path := range deleted {
-					out.Debug("deleted %s", path)
-				}
+func (r *Rule) matches(path string) bool {
+	if r.LocalPath != "" && !strings.HasPrefix(path, r.LocalPath+"/") {
+		return false
+	} else if r.pm != nil {
+		exclude, _ := r.pm.Matches(strings.TrimSuffix(path, "/"))
+		return !exclude
+	}
+	return true
+}
+
+// within indicates if a path is the local path
+// of the rule or a path inside its local path
+func (r *Rule) within(path string) bool {
+	return r.LocalPath == "" || path == r.LocalPath || strings.HasPrefix(path, r.LocalPath+"/")
+}
+
+// remotePath gets the remote path that corresponds to a local
+// path matched by the rule, where the local path of the rule
+// corresponds to the remote path of the rule
+func (r *Rule) remotePath(path string) string {
+	if r.LocalPath != "" {
+		path = strings.TrimPrefix(path, r.LocalPath+"/")
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(r.RemotePath, "/")+"/"+path, "/")
+}
+
+// localPath gets the local path that corresponds to a remote
+// path, or an empty string if the remote path, once cleaned,
+// is not within the remote path of the rule
+func (r *Rule) localPath(remotePath string) string {
+	remotePath = path.Clean("/" + remotePath)
+	prefix := strings.TrimSuffix(r.RemotePath, "/") + "/"
+	if !strings.HasPrefix(remotePath, prefix) {
+		return ""
+	}
+	localPath := remotePath[len(prefix):]
+	if r.LocalPath != "" {
+		localPath = r.LocalPath + "/" + localPath
+	}
+	if !r.within(localPath) {
+		return ""
+	}
+	return localPath
+}
+
+// Options represents file synchronization options
+type Options struct {
+	// Digest causes files to only be transferred when their content
+	// differs from the remote content, and performs an initial pass
+	// to reconcile differences that exist when synchronization starts
+	Digest bool
+	// Restart is the command that restarts the main process in the
+	// container, which is required if any rule has Restart set
+	Restart []string
+	// Agent indicates that the container has the sync agent installed
+	// at AgentPath, which provides the tools used to synchronize files
+	Agent bool
+}
+
+// Start starts synchronizing files between local directories and a container in a pod
+func Start(rules []Rule, options *Options, k kubectl.CLI, pod string, container string, out *output.Interface) (*Session, error) {
+	s := &Session{
+		options:   options,
+		k:         k,
+		pod:       pod,
+		container: container,
+		out:       out,
+	}
+
+	var roots []string
+	rootRules := map[string][]Rule{}
+	for _, rule := range rules {
+		if _, ok := rootRules[rule.Root]; !ok {
+			roots = append(roots, rule.Root)
+		}
+		rootRules[rule.Root] = append(rootRules[rule.Root], rule)
+		if !rule.Pull && s.stream == nil {
+			var err error
+			if s.stream, err = startStream(options, k, pod, container); err != nil {
+				return nil, pkgerror(err)
 			}
 		}
-		if len(updated) > 0 {
-			if err := k.Input(newTarchive(dir, sync, updated...), "exec", pod, "--container", container, "-i", "--", "tar", "-xof", "-", "-C", "/"); err != nil {
-				out.Debug("failed to synchronize updated files: %v", err)
-			} else {
-				for _, path := range updated {
-					out.Debug("updated %s", path)
+	}
+
+	for _, root := range roots {
+		if err := s.start(root, rootRules[root]); err != nil {
+			return nil, pkgerror(err)
+		}
+	}
+
+	return s, nil
+}
+
+// Session represents the synchronization of
+// a set of local directories with a container
+type Session struct {
+	options   *Options
+	k         kubectl.CLI
+	pod       string
+	container string
+	out       *output.Interface
+	mu        sync.Mutex
+	stream    *stream
+	summary   Summary
+}
+
+// push pushes a batch of changes from a local directory
+func (s *Session) push(dir string, rules []Rule, added []string, updated []string, deleted []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	op := s.out.Start("Pushing %s", describe(added, updated, deleted))
+	started := time.Now()
+	batch := &Batch{
+		Root:    dir,
+		Added:   len(added),
+		Updated: len(updated),
+		Deleted: len(deleted),
+	}
+
+	var err error
+	if s.stream.broken {
+		var restarted *stream
+		if restarted, err = startStream(s.options, s.k, s.pod, s.container); err == nil {
+			s.stream = restarted
+		}
+	}
+
+	if err == nil {
+		var skipped []string
+		bytes := s.stream.bytes
+		skipped, err = s.stream.push(dir, rules, deleted, append(updated, added...))
+		batch.Bytes = s.stream.bytes - bytes
+		batch.Skipped = len(skipped)
+		for _, path := range skipped {
+			s.out.Warning("skipped %s: unsupported file type, name or link target", filepath.Join(dir, path))
+		}
+	}
+
+	s.record(batch, started, err)
+	if err != nil {
+		op.Failed()
+		s.out.Warning("failed to synchronize files: %v", err)
+		return err
+	}
+	op.DoneWith("done (%d files, %s, %.1fs)", batch.Added+batch.Updated+batch.Deleted, formatBytes(batch.Bytes), batch.Duration)
+
+	for _, path := range deleted {
+		s.out.Debug("deleted %s", path)
+	}
+	for _, path := range updated {
+		s.out.Debug("updated %s", path)
+	}
+	for _, path := range added {
+		s.out.Debug("added %s", path)
+	}
+
+	runHooks(rules, s.options, s.k, s.pod, s.container, s.out, added, updated, deleted)
+
+	return nil
+}
+
+func (s *Session) start(dir string, rules []Rule) error {
+	var push []Rule
+	var pull []Rule
+	for _, rule := range rules {
+		if rule.Pull {
+			pull = append(pull, rule)
+		} else {
+			push = append(push, rule)
+		}
+	}
+
+	var p *puller
+	if len(pull) > 0 {
+		p = startPull(dir, pull, s.options, s.k, s.pod, s.container, s.out)
+	}
+
+	if len(push) == 0 {
+		return nil
+	}
+
+	base, err := loadIgnore(dir)
+	if err != nil {
+		return err
+	}
+	pm, err := newMatcher(push, base)
+	if err != nil {
+		return err
+	}
+
+	var m *manifest
+	if s.options.Digest {
+		if m, err = newManifest(dir, push, s.options, s.k, s.pod, s.container); err != nil {
+			return err
+		}
+	}
+
+	start(dir, pm, m != nil, func(added []string, updated []string, deleted []string) {
+		if p != nil {
+			// Do not push back files that were just pulled
+			added = p.filter(added)
+			updated = p.filter(updated)
+			defer p.pushed(added, updated)
+		}
+		if m != nil {
+			added = m.differ(added)
+			updated = m.differ(updated)
+		}
+		if len(added) == 0 && len(updated) == 0 && len(deleted) == 0 {
+			return
+		}
+		if err := s.push(dir, push, added, updated, deleted); err == nil && m != nil {
+			m.deleted(deleted)
+			m.pushed(updated)
+			m.pushed(added)
+		}
+	})
+
+	return nil
+}
+
+func runHooks(sync []Rule, options *Options, k kubectl.CLI, pod string, container string, out *output.Interface, paths ...[]string) {
+	restart := false
+	for _, rule := range sync {
+		touched := false
+		for _, paths := range paths {
+			for _, path := range paths {
+				if rule.matches(path) {
+					touched = true
+					break
 				}
 			}
 		}
-		if len(added) > 0 {
-			if err := k.Input(newTarchive(dir, sync, added...), "exec", pod, "--container", container, "-i", "--", "tar", "-xof", "-", "-C", "/"); err != nil {
-				out.Debug("failed to synchronize added files: %v", err)
-			} else {
-				for _, path := range added {
-					out.Debug("added %s", path)
-				}
+		if !touched {
+			continue
+		}
+		for _, run := range rule.Run {
+			if err := out.Do("Running %s", run, func() error {
+				stdout := out.NewStream(rule.RemotePath, output.LevelNormal, false)
+				defer stdout.Close()
+				return k.Pipe(strings.NewReader(""), stdout, append([]string{"exec", pod, "--container", container, "--"}, options.script(`cd "$1" && { `+run+`
+} 2>&1`, rule.RemotePath)...)...)
+			}); err != nil {
+				out.Warning("sync command failed: %v", err)
+				return
 			}
 		}
-	}))
+		restart = restart || rule.Restart
+	}
+
+	if restart {
+		out.Do("Restarting process", func() error {
+			return k.Run(append([]string{"exec", pod, "--container", container, "--"}, options.Restart...)...)
+		})
+	}
 }
@@ -0,0 +1,91 @@
+package filesync
+
+import (
+	"os"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/dockerignore"
+	"github.com/moby/patternmatcher"
+)
+
+// ignoreFiles are the files from which ignore patterns are
+// loaded, where only the first file that exists is used
+var ignoreFiles = []string{".kdoignore", ".dockerignore"}
+
+func loadIgnore(dir string) ([]string, error) {
+	for _, name := range ignoreFiles {
+		f, err := os.Open(dir + "/" + name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return dockerignore.ReadAll(f)
+	}
+
+	return nil, nil
+}
+
+// matcher excludes paths that are outside the local paths
+// of all rules or excluded by all rules they are within
+type matcher struct {
+	rules []Rule
+}
+
+// newMatcher compiles the ignore patterns of a set of rules on
+// top of a set of base patterns, and returns a matcher for them
+func newMatcher(rules []Rule, base []string) (*matcher, error) {
+	for i := range rules {
+		pm, err := patternmatcher.New(append(append([]string{}, base...), rules[i].Ignore...))
+		if err != nil {
+			return nil, err
+		}
+		rules[i].pm = pm
+	}
+
+	return &matcher{
+		rules: rules,
+	}, nil
+}
+
+// Matches indicates if a path is excluded
+func (m *matcher) Matches(path string) (bool, error) {
+	for _, rule := range m.rules {
+		if !rule.within(path) {
+			continue
+		} else if exclude, err := rule.pm.Matches(path); err != nil {
+			return false, err
+		} else if !exclude {
+			return false, nil
+		}
+	}
+
+	return len(m.rules) > 0, nil
+}
+
+// Exclusions indicates if any rule has exclusion patterns
+// that can include paths in otherwise excluded directories
+func (m *matcher) Exclusions() bool {
+	for _, rule := range m.rules {
+		if rule.pm.Exclusions() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// descend indicates if an excluded directory must still be
+// traversed, because it contains the local path of a rule
+// or exclusion patterns can include paths inside it
+func (m *matcher) descend(dir string) bool {
+	dir = strings.TrimSuffix(dir, "/")
+	for _, rule := range m.rules {
+		if rule.LocalPath != "" && strings.HasPrefix(rule.LocalPath+"/", dir+"/") {
+			return true
+		}
+	}
+
+	return m.Exclusions()
+}
@@ -0,0 +1,241 @@
+package filesync
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Changes are reported once no events have been received
+// for the quiet period, or once the maximum delay is reached
+const (
+	quiet    = 50 * time.Millisecond
+	maxDelay = 500 * time.Millisecond
+)
+
+type notifier struct {
+	root    string
+	pm      *matcher
+	watcher *fsnotify.Watcher
+	files   map[string]fileinfo
+}
+
+func newNotifier(root string, pm *matcher, baseline fileinfos) (*notifier, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	n := &notifier{
+		root:    root,
+		pm:      pm,
+		watcher: watcher,
+	}
+	n.reset(baseline)
+
+	if err = n.watch(""); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	return n, nil
+}
+
+func (n *notifier) reset(baseline fileinfos) {
+	n.files = map[string]fileinfo{}
+	for _, file := range baseline {
+		n.files[file.path] = file
+	}
+}
+
+func (n *notifier) baseline() fileinfos {
+	var files fileinfos
+	for _, file := range n.files {
+		files = append(files, file)
+	}
+	sort.Sort(files)
+	return files
+}
+
+// watch watches a directory and its subdirectories,
+// following the same traversal rules as find2
+func (n *notifier) watch(dir string) error {
+	if err := n.watcher.Add(filepath.Join(n.root, dir)); err != nil {
+		return err
+	}
+
+	file, err := os.Open(filepath.Join(n.root, dir))
+	if err != nil {
+		return nil
+	}
+	infos, err := file.Readdir(-1)
+	file.Close()
+	if err != nil {
+		return nil
+	}
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		path := dir + info.Name()
+		if exclude, _ := n.pm.Matches(path); !exclude || n.pm.descend(path) {
+			if err = n.watch(path + "/"); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (n *notifier) remove(path string, deleted map[string]bool) {
+	for p := range n.files {
+		if p == path || strings.HasPrefix(p, path+"/") {
+			delete(n.files, p)
+			deleted[p] = true
+		}
+	}
+}
+
+func (n *notifier) update(path string, added, updated, deleted map[string]bool) {
+	info, err := os.Lstat(filepath.Join(n.root, path))
+	if err != nil {
+		n.remove(path, deleted)
+		return
+	}
+
+	exclude, _ := n.pm.Matches(path)
+	if info.IsDir() {
+		if _, ok := n.files[path]; ok {
+			// A file was replaced by a directory
+			n.remove(path, deleted)
+		}
+		if !exclude || n.pm.descend(path) {
+			n.watch(path + "/")
+			latest := find2(n.root, nil, path+"/", n.pm)
+			if !exclude {
+				latest = append(latest, fileinfo{
+					path: path + "/",
+					mode: info.Mode(),
+					mod:  info.ModTime(),
+				})
+			}
+			for _, file := range latest {
+				n.updateOne(file, added, updated)
+			}
+		}
+		return
+	}
+
+	if _, ok := n.files[path+"/"]; ok {
+		// A directory was replaced by a file
+		n.remove(path+"/", deleted)
+	}
+	if !exclude {
+		n.updateOne(fileinfo{
+			path: path,
+			mode: info.Mode(),
+			mod:  info.ModTime(),
+		}, added, updated)
+	}
+}
+
+func (n *notifier) updateOne(file fileinfo, added, updated map[string]bool) {
+	if baseline, ok := n.files[file.path]; !ok {
+		added[file.path] = true
+	} else if baseline.mode != file.mode || baseline.mod.UnixNano() < file.mod.UnixNano() {
+		if !added[file.path] {
+			updated[file.path] = true
+		}
+	}
+	n.files[file.path] = file
+}
+
+func sorted(paths map[string]bool) []string {
+	var s []string
+	for path := range paths {
+		s = append(s, path)
+	}
+	sort.Strings(s)
+	return s
+}
+
+func (n *notifier) run(fn func(added []string, updated []string, deleted []string)) {
+	defer n.watcher.Close()
+
+	dirty := map[string]bool{}
+	rescan := false
+	var timer <-chan time.Time
+	var deadline time.Time
+
+	for {
+		select {
+		case event, ok := <-n.watcher.Events:
+			if !ok {
+				return
+			}
+			path, err := filepath.Rel(n.root, event.Name)
+			if err != nil || path == "." {
+				continue
+			}
+			dirty[filepath.ToSlash(path)] = true
+		case err, ok := <-n.watcher.Errors:
+			if !ok {
+				return
+			}
+			if err == fsnotify.ErrEventOverflow {
+				rescan = true
+			}
+		case <-timer:
+			added, updated, deleted := map[string]bool{}, map[string]bool{}, map[string]bool{}
+			if rescan {
+				latest := find(n.root, n.pm)
+				a, u, d := compare(n.baseline(), latest)
+				for _, path := range a {
+					added[path] = true
+				}
+				for _, path := range u {
+					updated[path] = true
+				}
+				for _, path := range d {
+					deleted[path] = true
+				}
+				n.reset(latest)
+				n.watch("")
+			} else {
+				for path := range dirty {
+					n.update(path, added, updated, deleted)
+				}
+			}
+			for path := range added {
+				if deleted[path] {
+					// Deleted and re-created within the batch
+					delete(deleted, path)
+					delete(added, path)
+					updated[path] = true
+				}
+			}
+			dirty = map[string]bool{}
+			rescan = false
+			timer = nil
+			if len(added) > 0 || len(updated) > 0 || len(deleted) > 0 {
+				fn(sorted(added), sorted(updated), sorted(deleted))
+			}
+			continue
+		}
+
+		now := time.Now()
+		if timer == nil {
+			deadline = now.Add(maxDelay)
+		}
+		wait := quiet
+		if now.Add(wait).After(deadline) {
+			wait = deadline.Sub(now)
+		}
+		timer = time.After(wait)
+	}
+}
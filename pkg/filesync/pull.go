@@ -0,0 +1,353 @@
+package filesync
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stepro/kdo/pkg/kubectl"
+	"github.com/stepro/kdo/pkg/output"
+)
+
+const pullInterval = 1 * time.Second
+
+// listScript outputs the modification time, size
+// and path of all files under a set of remote directories
+const listScript = `for d; do
+  [ -d "$d" ] || continue
+  find "$d" -type f -exec stat -c '%Y %s %n' {} +
+done
+`
+
+type remoteinfo struct {
+	mod  int64
+	size int64
+}
+
+type localinfo struct {
+	mod  time.Time
+	size int64
+}
+
+// puller mirrors changes to files in remote directories
+// into local directories, detecting conflicting changes
+type puller struct {
+	root      string
+	rules     []Rule
+	opt       *Options
+	k         kubectl.CLI
+	pod       string
+	container string
+	out       *output.Interface
+	started   time.Time
+	remote    map[string]remoteinfo
+	mu        sync.Mutex
+	local     map[string]localinfo
+}
+
+func (p *puller) list() (map[string]remoteinfo, error) {
+	args := append([]string{"exec", p.pod, "--container", p.container, "--"}, p.opt.script(listScript)...)
+	for _, rule := range p.rules {
+		args = append(args, rule.RemotePath)
+	}
+	lines, err := p.k.Lines(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]remoteinfo{}
+	for _, line := range lines {
+		tokens := strings.SplitN(line, " ", 3)
+		if len(tokens) != 3 {
+			continue
+		}
+		mod, err := strconv.ParseInt(tokens[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		size, err := strconv.ParseInt(tokens[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		files[tokens[2]] = remoteinfo{
+			mod:  mod,
+			size: size,
+		}
+	}
+
+	return files, nil
+}
+
+// localPath gets the build context relative path
+// that corresponds to an absolute remote path
+func (p *puller) localPath(remotePath string) string {
+	for _, rule := range p.rules {
+		if path := rule.localPath(remotePath); path != "" {
+			return path
+		}
+	}
+	return ""
+}
+
+// unchanged indicates if a local file is
+// unchanged since it was last pulled
+func (p *puller) unchanged(path string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l, ok := p.local[path]
+	if !ok {
+		return false
+	}
+
+	info, err := os.Lstat(filepath.Join(p.root, path))
+	if err != nil {
+		return false
+	}
+
+	return info.ModTime().Equal(l.mod) && info.Size() == l.size
+}
+
+// conflicts indicates if a local file has changed
+// in a way that conflicts with a remote change
+func (p *puller) conflicts(path string) bool {
+	info, err := os.Lstat(filepath.Join(p.root, path))
+	if os.IsNotExist(err) {
+		return false
+	} else if err != nil {
+		return true
+	}
+
+	p.mu.Lock()
+	l, ok := p.local[path]
+	p.mu.Unlock()
+
+	if !ok {
+		return info.ModTime().After(p.started)
+	}
+
+	return !info.ModTime().Equal(l.mod) || info.Size() != l.size
+}
+
+// contains indicates if a local file is inside the root directory,
+// once symbolic links in its nearest existing directory are resolved
+func (p *puller) contains(name string) bool {
+	root, err := filepath.EvalSymlinks(p.root)
+	if err != nil {
+		return false
+	}
+
+	dir, rest := filepath.Dir(name), ""
+	for {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			name = filepath.Join(resolved, rest, filepath.Base(name))
+			break
+		} else if !os.IsNotExist(err) || filepath.Dir(dir) == dir {
+			return false
+		}
+		dir, rest = filepath.Dir(dir), filepath.Join(filepath.Base(dir), rest)
+	}
+
+	rel, err := filepath.Rel(root, name)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (p *puller) pull(remotePaths []string) error {
+	args := append([]string{"exec", p.pod, "--container", p.container, "--"}, p.opt.command("tar", "-cf", "-", "-C", "/")...)
+	for _, remotePath := range remotePaths {
+		args = append(args, strings.TrimPrefix(remotePath, "/"))
+	}
+
+	var archive bytes.Buffer
+	if err := p.k.Pipe(strings.NewReader(""), &archive, args...); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(&archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		path := p.localPath("/" + hdr.Name)
+		if path == "" {
+			continue
+		}
+		name := filepath.Join(p.root, filepath.FromSlash(path))
+		if !p.contains(name) {
+			p.out.Warning("skipped pulling %s: outside of %s", hdr.Name, p.root)
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode).Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, tr)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		if err = os.Chtimes(name, hdr.ModTime, hdr.ModTime); err != nil {
+			return err
+		}
+		p.record(path)
+		p.out.Debug("pulled %s", path)
+	}
+
+	return nil
+}
+
+func (p *puller) record(path string) {
+	info, err := os.Lstat(filepath.Join(p.root, path))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err != nil {
+		delete(p.local, path)
+		return
+	}
+
+	p.local[path] = localinfo{
+		mod:  info.ModTime(),
+		size: info.Size(),
+	}
+}
+
+// filter filters out paths that are unchanged since they were pulled
+func (p *puller) filter(paths []string) []string {
+	var result []string
+	for _, path := range paths {
+		if !p.unchanged(path) {
+			result = append(result, path)
+		}
+	}
+	return result
+}
+
+// pushed records the local state of pushed files
+// that are also in a remote directory being pulled
+func (p *puller) pushed(paths ...[]string) {
+	for _, paths := range paths {
+		for _, path := range paths {
+			for _, rule := range p.rules {
+				if rule.matches(path) {
+					p.record(path)
+					break
+				}
+			}
+		}
+	}
+}
+
+func (p *puller) sync(latest map[string]remoteinfo) {
+	var pull []string
+	for remotePath, r := range latest {
+		if b, ok := p.remote[remotePath]; ok && b == r {
+			continue
+		}
+		path := p.localPath(remotePath)
+		if path == "" {
+			continue
+		}
+		if p.remote == nil {
+			// Initially only pull files that do not exist locally
+			if _, err := os.Lstat(filepath.Join(p.root, path)); err == nil {
+				p.record(path)
+				continue
+			}
+		}
+		if p.conflicts(path) {
+			p.out.Warning("conflict: %s was changed both locally and in the container; keeping local changes", path)
+			continue
+		}
+		pull = append(pull, remotePath)
+	}
+
+	if p.remote != nil {
+		for remotePath := range p.remote {
+			if _, ok := latest[remotePath]; ok {
+				continue
+			}
+			path := p.localPath(remotePath)
+			if path == "" {
+				continue
+			}
+			if p.conflicts(path) {
+				p.out.Warning("conflict: %s was changed locally and deleted in the container; keeping local changes", path)
+				continue
+			}
+			if name := filepath.Join(p.root, path); !p.contains(name) {
+				continue
+			} else if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				p.out.Warning("failed to delete pulled file %s: %v", path, err)
+				continue
+			}
+			p.record(path)
+			p.out.Debug("deleted pulled file %s", path)
+		}
+	}
+
+	if len(pull) > 0 {
+		if err := p.pull(pull); err != nil {
+			p.out.Warning("failed to pull files: %v", err)
+			// Try again on the next iteration
+			for _, remotePath := range pull {
+				delete(latest, remotePath)
+			}
+		}
+	}
+
+	p.remote = latest
+}
+
+func (p *puller) run() {
+	failing := false
+	for {
+		latest, err := p.list()
+		if err != nil {
+			// Only warn when listing starts failing
+			if !failing {
+				p.out.Warning("failed to list remote files: %v", err)
+			}
+			failing = true
+		} else {
+			failing = false
+			p.sync(latest)
+		}
+		time.Sleep(pullInterval)
+	}
+}
+
+func startPull(dir string, pull []Rule, options *Options, k kubectl.CLI, pod string, container string, out *output.Interface) *puller {
+	p := &puller{
+		root:      dir,
+		rules:     pull,
+		opt:       options,
+		k:         k,
+		pod:       pod,
+		container: container,
+		out:       out,
+		started:   time.Now(),
+		local:     map[string]localinfo{},
+	}
+
+	go p.run()
+
+	return p
+}
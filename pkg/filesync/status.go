@@ -0,0 +1,96 @@
+package filesync
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/stepro/kdo/pkg/output"
+)
+
+// Batch represents the result of pushing a batch of changes
+type Batch struct {
+	Kind    string `json:"kind"`
+	Root    string `json:"root"`
+	Added   int    `json:"added"`
+	Updated int    `json:"updated"`
+	Deleted int    `json:"deleted"`
+	Skipped int    `json:"skipped,omitempty"`
+	Bytes   int64  `json:"bytes"`
+	// Duration is the duration of the push in seconds
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// Summary represents the results of a synchronization session
+type Summary struct {
+	Kind    string `json:"kind"`
+	Batches int    `json:"batches"`
+	Failed  int    `json:"failed"`
+	Files   int    `json:"files"`
+	Bytes   int64  `json:"bytes"`
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n < 1<<10:
+		return fmt.Sprintf("%d B", n)
+	case n < 1<<20:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	}
+}
+
+// describe describes the changes in a batch
+func describe(added []string, updated []string, deleted []string) string {
+	for _, paths := range [][]string{added, updated, deleted} {
+		if len(paths) == 1 && len(added)+len(updated)+len(deleted) == 1 {
+			return paths[0]
+		}
+	}
+	return fmt.Sprintf("%d changes", len(added)+len(updated)+len(deleted))
+}
+
+// record records the result of a batch and reports it
+func (s *Session) record(batch *Batch, started time.Time, err error) {
+	batch.Kind = "syncBatch"
+	batch.Duration = time.Since(started).Seconds()
+	if err != nil {
+		batch.Error = err.Error()
+	}
+
+	s.summary.Batches++
+	if err != nil {
+		s.summary.Failed++
+	} else {
+		s.summary.Files += batch.Added + batch.Updated + batch.Deleted
+		s.summary.Bytes += batch.Bytes
+	}
+
+	s.out.Object(output.LevelVerbose, batch)
+}
+
+// Summary gets a summary of the results of the session
+func (s *Session) Summary() Summary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	summary := s.summary
+	summary.Kind = "syncSummary"
+
+	return summary
+}
+
+// Report reports a summary of the results of the session
+func (s *Session) Report() {
+	summary := s.Summary()
+	if summary.Batches == 0 {
+		return
+	}
+
+	s.out.Info("Synchronized %d files (%s) in %d batches", summary.Files, formatBytes(summary.Bytes), summary.Batches)
+	if summary.Failed > 0 {
+		s.out.Warning("%d of %d sync batches failed", summary.Failed, summary.Batches)
+	}
+	s.out.Object(output.LevelVerbose, summary)
+}
@@ -0,0 +1,274 @@
+package filesync
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/stepro/kdo/pkg/kubectl"
+	"github.com/stepro/kdo/pkg/output"
+)
+
+// receiveScript reads a line-framed stream of operations from
+// standard input and applies them to the container file system:
+//
+//	D path                      delete a file or directory
+//	d mode path                 create a directory
+//	F mode mtime size path      write a file from the next size bytes
+//	L path                      link a path to the target on the next line
+//	A owner mode path           set the owner of a path and the mode of a file
+//	S id                        report the failures since the last S
+//
+// File content is read exactly using dd, as other tools may consume
+// more of the input than they need when reading from a pipe
+const receiveScript = `if echo | dd bs=1 count=1 iflag=fullblock >/dev/null 2>&1; then
+  fullblock=iflag=fullblock
+fi
+copy() {
+  n=$1
+  if [ -n "$fullblock" ] && [ $n -ge 65536 ]; then
+    dd bs=65536 count=$((n / 65536)) $fullblock 2>/dev/null || return
+    n=$((n % 65536))
+  fi
+  [ $n -eq 0 ] || dd bs=1 count=$n 2>/dev/null
+}
+replace() {
+  if [ -d "$1" ] && [ ! -L "$1" ]; then
+    rm -rf "$1"
+  fi
+  dir=${1%/*}
+  [ -z "$dir" ] || mkdir -p "$dir"
+}
+failed=0
+echo ready
+while IFS= read -r line; do
+  op=${line%% *}
+  line=${line#* }
+  case $op in
+  D)
+    rm -rf "$line" || failed=$((failed + 1))
+    ;;
+  d)
+    mode=${line%% *} p=${line#* }
+    if [ -e "$p" ] && [ ! -d "$p" ] || [ -L "$p" ]; then
+      rm -f "$p"
+    fi
+    { mkdir -p "$p" && chmod "$mode" "$p"; } || failed=$((failed + 1))
+    ;;
+  F)
+    mode=${line%% *} line=${line#* }
+    mtime=${line%% *} line=${line#* }
+    size=${line%% *} p=${line#* }
+    tmp=$p.kdo-sync
+    replace "$p"
+    if (: > "$tmp") 2>/dev/null; then
+      if copy $size > "$tmp"; then
+        chmod "$mode" "$tmp"
+        touch -c -d "@$mtime" "$tmp" 2>/dev/null
+        mv -f "$tmp" "$p" || failed=$((failed + 1))
+      else
+        rm -f "$tmp"
+        failed=$((failed + 1))
+      fi
+    else
+      copy $size > /dev/null
+      failed=$((failed + 1))
+    fi
+    ;;
+  L)
+    p=$line
+    IFS= read -r target
+    replace "$p"
+    { rm -f "$p" && ln -s "$target" "$p"; } || failed=$((failed + 1))
+    ;;
+  A)
+    owner=${line%% *} line=${line#* }
+    mode=${line%% *} p=${line#* }
+    {
+      { [ "$owner" = - ] || chown -h "$owner" "$p"; } &&
+      { [ "$mode" = - ] || [ -L "$p" ] || [ ! -f "$p" ] || chmod "$mode" "$p"; }
+    } || failed=$((failed + 1))
+    ;;
+  S)
+    echo "S $line $failed"
+    failed=0
+    ;;
+  esac
+done
+`
+
+// stream is a long-lived channel to a receiver in the
+// container to which batches of changes are pushed
+type stream struct {
+	w     *io.PipeWriter
+	bw    *bufio.Writer
+	acks  chan string
+	ended chan error
+	id    int
+	// bytes is the total size of the file content pushed
+	bytes int64
+	// broken indicates that the stream can no longer be used
+	broken bool
+}
+
+func startStream(options *Options, k kubectl.CLI, pod string, container string) (*stream, error) {
+	r, w := io.Pipe()
+	s := &stream{
+		w:     w,
+		bw:    bufio.NewWriterSize(w, 64*1024),
+		acks:  make(chan string, 1),
+		ended: make(chan error, 1),
+	}
+
+	stdout := output.NewLineWriter(func(line string) {
+		s.acks <- line
+	})
+
+	go func() {
+		err := k.Pipe(r, stdout, append([]string{"exec", pod, "--container", container, "-i", "--"}, options.script(receiveScript)...)...)
+		if err == nil {
+			err = errors.New("receiver ended unexpectedly")
+		}
+		r.CloseWithError(err)
+		s.ended <- err
+	}()
+
+	if line, err := s.read(); err != nil || line != "ready" {
+		s.close()
+		if err == nil {
+			err = fmt.Errorf("unexpected receiver output: %s", line)
+		}
+		return nil, fmt.Errorf("cannot start receiver: %v", err)
+	}
+
+	return s, nil
+}
+
+// read waits for the receiver to output a line
+func (s *stream) read() (string, error) {
+	select {
+	case line := <-s.acks:
+		return line, nil
+	case err := <-s.ended:
+		s.ended <- err
+		return "", err
+	}
+}
+
+func (s *stream) close() {
+	s.w.Close()
+	s.broken = true
+}
+
+// write writes the operation that pushes a local file, directory
+// or symbolic link, or returns false if it cannot be represented;
+// errors writing to the stream are reported when it is flushed
+func (s *stream) write(root string, path string, remotePath string) (bool, error) {
+	name := filepath.Join(root, path)
+	info, err := os.Lstat(name)
+	if err != nil {
+		return false, err
+	}
+
+	switch mode := info.Mode(); {
+	case mode.IsDir():
+		fmt.Fprintf(s.bw, "d %o %s\n", mode.Perm(), remotePath)
+	case mode.IsRegular():
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprintf(s.bw, "F %o %d %d %s\n", mode.Perm(), info.ModTime().Unix(), len(data), remotePath)
+		s.bw.Write(data)
+		s.bytes += int64(len(data))
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(name)
+		if err != nil {
+			return false, err
+		} else if strings.ContainsAny(target, "\r\n") {
+			return false, nil
+		}
+		fmt.Fprintf(s.bw, "L %s\n%s\n", remotePath, filepath.ToSlash(target))
+	default:
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// push pushes a batch of changes, where deletions are applied first,
+// and returns the paths that were skipped because they are unsupported,
+// including paths and link targets that would break the line framing
+func (s *stream) push(root string, sync []Rule, deleted []string, changed []string) ([]string, error) {
+	var skipped []string
+	var failed error
+
+	for _, path := range deleted {
+		if strings.ContainsAny(path, "\r\n") {
+			skipped = append(skipped, path)
+			continue
+		}
+		for _, remotePath := range remotePaths(sync, path) {
+			fmt.Fprintf(s.bw, "D %s\n", remotePath)
+		}
+	}
+
+	for _, path := range changed {
+		if strings.ContainsAny(path, "\r\n") {
+			skipped = append(skipped, path)
+			continue
+		}
+		for _, rule := range sync {
+			if !rule.matches(path) {
+				continue
+			}
+			remotePath := rule.remotePath(path)
+			if ok, err := s.write(root, path, remotePath); err != nil {
+				failed = err
+				break
+			} else if !ok {
+				skipped = append(skipped, path)
+				break
+			}
+			if rule.Chown != "" || rule.Chmod != "" {
+				owner, mode := rule.Chown, rule.Chmod
+				if owner == "" {
+					owner = "-"
+				}
+				if mode == "" {
+					mode = "-"
+				}
+				fmt.Fprintf(s.bw, "A %s %s %s\n", owner, mode, remotePath)
+			}
+		}
+	}
+
+	s.id++
+	id := strconv.Itoa(s.id)
+	fmt.Fprintf(s.bw, "S %s\n", id)
+	if err := s.bw.Flush(); err != nil {
+		s.close()
+		return nil, err
+	}
+
+	line, err := s.read()
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	tokens := strings.Split(line, " ")
+	if len(tokens) != 3 || tokens[0] != "S" || tokens[1] != id {
+		s.close()
+		return nil, fmt.Errorf("unexpected receiver output: %s", line)
+	} else if tokens[2] != "0" {
+		failed = fmt.Errorf("%s operations failed in the container", tokens[2])
+	}
+
+	return skipped, failed
+}
@@ -4,9 +4,6 @@ import (
 	"os"
 	"sort"
 	"time"
-
-	"github.com/moby/buildkit/frontend/dockerfile/dockerignore"
-	"github.com/moby/patternmatcher"
 )
 
 type fileinfo struct {
@@ -17,7 +14,7 @@ type fileinfo struct {
 
 const interval = 200 * time.Millisecond
 
-func find2(root string, files []fileinfo, dir string, pm *patternmatcher.PatternMatcher) []fileinfo {
+func find2(root string, files []fileinfo, dir string, pm *matcher) []fileinfo {
 	file, err := os.Open(root + "/" + dir)
 	if err != nil {
 		return nil
@@ -40,7 +37,7 @@ func find2(root string, files []fileinfo, dir string, pm *patternmatcher.Pattern
 				mod:  info.ModTime(),
 			})
 		}
-		if info.IsDir() && (!exclude || pm.Exclusions()) {
+		if info.IsDir() && (!exclude || pm.descend(path)) {
 			files = find2(root, files, path, pm)
 		}
 	}
@@ -53,7 +50,7 @@ func (a fileinfos) Len() int           { return len(a) }
 func (a fileinfos) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a fileinfos) Less(i, j int) bool { return a[i].path < a[j].path }
 
-func find(root string, pm *patternmatcher.PatternMatcher) fileinfos {
+func find(root string, pm *matcher) fileinfos {
 	var files fileinfos
 	files = find2(root, files, "", pm)
 	if files != nil {
@@ -91,39 +88,37 @@ func compare(baseline fileinfos, latest fileinfos) (added []string, updated []st
 	return
 }
 
-func start(dir string, fn func(added []string, updated []string, deleted []string)) error {
-	var patterns []string
-	f, err := os.Open(dir + "/.dockerignore")
-	if err == nil {
-		patterns, err = dockerignore.ReadAll(f)
-		f.Close()
-		if err != nil {
-			return err
+func start(dir string, pm *matcher, initial bool, fn func(added []string, updated []string, deleted []string)) {
+	baseline := find(dir, pm)
+
+	if initial && len(baseline) > 0 {
+		var added []string
+		for _, file := range baseline {
+			added = append(added, file.path)
 		}
+		fn(added, nil, nil)
 	}
 
-	pm, err := patternmatcher.New(patterns)
-	if err != nil {
-		return err
+	if n, err := newNotifier(dir, pm, baseline); err == nil {
+		go n.run(fn)
+		return
 	}
 
-	baseline := find(dir, pm)
+	go poll(dir, pm, baseline, fn)
+}
 
-	go func() {
-		for {
-			time.Sleep(interval)
-			latest := find(dir, pm)
-			if latest != nil {
-				if baseline != nil {
-					added, updated, deleted := compare(baseline, latest)
-					if len(added) > 0 || len(updated) > 0 || len(deleted) > 0 {
-						fn(added, updated, deleted)
-					}
+func poll(dir string, pm *matcher, baseline fileinfos, fn func(added []string, updated []string, deleted []string)) {
+	for {
+		time.Sleep(interval)
+		latest := find(dir, pm)
+		if latest != nil {
+			if baseline != nil {
+				added, updated, deleted := compare(baseline, latest)
+				if len(added) > 0 || len(updated) > 0 || len(deleted) > 0 {
+					fn(added, updated, deleted)
 				}
-				baseline = latest
 			}
+			baseline = latest
 		}
-	}()
-
-	return nil
+	}
 }
@@ -0,0 +1,216 @@
+package imagebuild
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/moby/buildkit/frontend/dockerfile/dockerignore"
+	"github.com/moby/patternmatcher"
+)
+
+// Digest computes a digest of the files in a build context
+// and any additional local build contexts that are not excluded
+// by their .dockerignore files, along with the dockerfile and
+// options used to build it
+func Digest(context string, options *Options) (string, error) {
+	h := sha256.New()
+
+	fmt.Fprintf(h, "target %s\n", options.Target)
+	fmt.Fprintf(h, "platform %s\n", options.Platform)
+	args := append([]string{}, options.Args...)
+	sort.Strings(args)
+	for _, arg := range args {
+		fmt.Fprintf(h, "arg %s\n", arg)
+	}
+
+	if err := digestFile(h, "dockerfile", dockerfile(context, options)); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	for _, secret := range options.Secrets {
+		fmt.Fprintf(h, "secret %s\n", secret)
+	}
+	for _, ssh := range options.SSH {
+		fmt.Fprintf(h, "ssh %s\n", ssh)
+	}
+	for _, context := range options.Contexts {
+		name, value, local := namedContext(context)
+		if !local {
+			fmt.Fprintf(h, "context %s %s\n", name, value)
+		} else if err := digestContext(h, name+":", value); err != nil {
+			return "", err
+		}
+	}
+
+	if err := digestContext(h, "", context); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// digestContext adds the files in a build context
+// to a digest, where each path is given a prefix
+func digestContext(w io.Writer, prefix string, context string) error {
+	return walk(context, func(path string, name string, info os.FileInfo) error {
+		path = prefix + path
+		mode := info.Mode()
+		switch {
+		case mode.IsDir():
+			fmt.Fprintf(w, "dir %s %o\n", path, mode.Perm())
+		case mode&os.ModeSymlink != 0:
+			target, err := os.Readlink(name)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "link %s %s\n", path, target)
+		case mode.IsRegular():
+			return digestFile(w, fmt.Sprintf("file %s %o", path, mode.Perm()), name)
+		}
+		return nil
+	})
+}
+
+// dockerfile resolves the path of the dockerfile, which is
+// relative to the current directory if it exists there, or
+// otherwise to the build context
+func dockerfile(context string, options *Options) string {
+	file := options.File
+	if file == "" {
+		return filepath.Join(context, "Dockerfile")
+	}
+	if !filepath.IsAbs(file) {
+		if _, err := os.Stat(file); err != nil {
+			file = filepath.Join(context, file)
+		}
+	}
+	return file
+}
+
+// walk walks the files in a build context that are
+// not excluded by its .dockerignore file, in order
+func walk(context string, fn func(path string, name string, info os.FileInfo) error) error {
+	var patterns []string
+	f, err := os.Open(filepath.Join(context, ".dockerignore"))
+	if err == nil {
+		patterns, err = dockerignore.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	pm, err := patternmatcher.New(patterns)
+	if err != nil {
+		return err
+	}
+
+	return filepath.Walk(context, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		path, err := filepath.Rel(context, name)
+		if err != nil || path == "." {
+			return err
+		}
+		path = filepath.ToSlash(path)
+		if exclude, _ := pm.Matches(path); exclude {
+			if info.IsDir() && !pm.Exclusions() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return fn(path, name, info)
+	})
+}
+
+func digestFile(w io.Writer, label string, name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, file); err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s %x\n", label, h.Sum(nil))
+
+	return err
+}
+
+// CacheEntry represents an image that was previously built
+type CacheEntry struct {
+	Digest string `json:"digest"`
+	Image  string `json:"image"`
+	Node   string `json:"node"`
+}
+
+func cacheFile(hash string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "kdo", "images", hash+".json"), nil
+}
+
+// Cached gets the image that was last built for a hash, if any
+func Cached(hash string) *CacheEntry {
+	name, err := cacheFile(hash)
+	if err != nil {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil
+	}
+
+	var entry CacheEntry
+	if err = json.Unmarshal(data, &entry); err != nil {
+		return nil
+	}
+
+	return &entry
+}
+
+// Remember records the image that was last built for a hash
+func Remember(hash string, entry *CacheEntry) error {
+	name, err := cacheFile(hash)
+	if err != nil {
+		return pkgerror(err)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return pkgerror(err)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return pkgerror(err)
+	}
+
+	return pkgerror(ioutil.WriteFile(name, data, 0644))
+}
+
+// Forget forgets the image that was last built for a hash
+func Forget(hash string) error {
+	name, err := cacheFile(hash)
+	if err != nil {
+		return pkgerror(err)
+	}
+
+	if err = os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return pkgerror(err)
+	}
+
+	return nil
+}
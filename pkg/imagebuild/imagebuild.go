@@ -3,7 +3,6 @@ package imagebuild
 import (
 	"fmt"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"time"
 
@@ -27,10 +26,34 @@ type Options struct {
 	File   string
 	Args   []string
 	Target string
+	// Secrets are secrets exposed to the build in
+	// the form id=name[,src=path] or id=name,env=var
+	Secrets []string
+	// SSH are SSH agent sockets or keys exposed to
+	// the build in the form default|id[=socket|key[,...]]
+	SSH []string
+	// Contexts are additional named build contexts in the form
+	// name=path, where the path may also be a URL such as
+	// docker-image://image or https://host/repo.git
+	Contexts []string
+	// Platform is the target platform of the build
+	Platform string
+	// NoCache disables use of the build cache
+	NoCache bool
+}
+
+// namedContext splits a named build context into its
+// name and value, and indicates if it is a local path
+func namedContext(context string) (string, string, bool) {
+	nameValue := strings.SplitN(context, "=", 2)
+	if len(nameValue) == 1 {
+		return nameValue[0], "", false
+	}
+	return nameValue[0], nameValue[1], !strings.Contains(nameValue[1], "://")
 }
 
 // Build builds an image on the node that is running a pod
-func Build(k kubectl.CLI, pod string, bc buildctl.CLI, d docker.CLI, options *Options, image string, context string, out *output.Interface) error {
+func Build(k kubectl.CLI, pod string, serverOptions *server.Options, bc buildctl.CLI, d docker.CLI, options *Options, image string, context string, out *output.Interface) error {
 	return pkgerror(out.Do("Building image", func(op output.Operation) error {
 		op.Progress("determining build node")
 		var node string
@@ -46,89 +69,161 @@ func Build(k kubectl.CLI, pod string, bc buildctl.CLI, d docker.CLI, options *Op
 		}
 
 		op.Progress("determining build pod")
-		nodePods, err := server.NodePods(k, out)
+		nodePod, err := server.NodePod(k, serverOptions, node, out)
 		if err != nil {
 			return err
 		}
-		if nodePods[node] == "" {
-			return fmt.Errorf("cannot build on node %s", node)
-		}
 
 		if bc != nil {
 			op.Progress("connecting to buildkit daemon")
 		} else {
 			op.Progress("connecting to docker daemon")
 		}
-		builderPort, stop, err := portforward.StartOne(k, "kube-system", nodePods[node], "2375")
+		builderPort, stop, err := portforward.StartOne(k, serverOptions.Namespace, nodePod, "2375")
 		if err != nil {
 			return err
 		}
 		defer stop()
 
-		var buildArgs []string
-		if bc != nil {
-			buildArgs = []string{
-				"--addr", "tcp://localhost:" + builderPort,
-				"build",
-				"--frontend", "dockerfile.v0",
-				"--local", "context=" + context,
-				"--local", "dockerfile=" + context,
-			}
-			if options.File == "" {
+		return build(bc, d, options, "localhost:"+builderPort, image, context, false, op, out)
+	}))
+}
+
+// BuildAndPush builds an image locally and pushes it to a registry
+func BuildAndPush(bc buildctl.CLI, d docker.CLI, options *Options, image string, context string, out *output.Interface) error {
+	return pkgerror(out.Do("Building image", func(op output.Operation) error {
+		return build(bc, d, options, "", image, context, true, op, out)
+	}))
+}
+
+// buildx indicates if the docker CLI builds with buildx,
+// which supports progress output as rawjson solve statuses
+func buildx(d docker.CLI) bool {
+	supported := false
+	d.EachLine([]string{"buildx", "build", "--help"}, func(line string) {
+		if strings.Contains(line, "rawjson") {
+			supported = true
+		}
+	})
+	return supported
+}
+
+func build(bc buildctl.CLI, d docker.CLI, options *Options, addr string, image string, context string, push bool, op output.Operation, out *output.Interface) error {
+	var buildArgs []string
+	rawjson := bc != nil || buildx(d)
+	if bc != nil {
+		if addr != "" {
+			buildArgs = []string{"--addr", "tcp://" + addr}
+		}
+		buildArgs = append(buildArgs,
+			"build",
+			"--progress", "rawjson",
+			"--frontend", "dockerfile.v0",
+			"--local", "context="+context,
+		)
+		if options.File == "" {
+			buildArgs = append(buildArgs, "--local", "dockerfile="+context)
+		} else {
+			dir, file := filepath.Split(options.File)
+			if dir == "" {
 				buildArgs = append(buildArgs, "--local", "dockerfile="+context)
 			} else {
-				dir, file := filepath.Split(options.File)
-				if dir == "" {
-					buildArgs = append(buildArgs, "--local", "dockerfile="+context)
-				} else {
-					buildArgs = append(buildArgs, "--local", "dockerfile="+dir)
-				}
-				buildArgs = append(buildArgs, "--opt", "filename="+file)
+				buildArgs = append(buildArgs, "--local", "dockerfile="+dir)
 			}
-			for _, arg := range options.Args {
-				buildArgs = append(buildArgs, "--opt", "build-arg:"+arg)
+			buildArgs = append(buildArgs, "--opt", "filename="+file)
+		}
+		for _, arg := range options.Args {
+			buildArgs = append(buildArgs, "--opt", "build-arg:"+arg)
+		}
+		if options.Target != "" {
+			buildArgs = append(buildArgs, "--opt", "target="+options.Target)
+		}
+		for _, secret := range options.Secrets {
+			buildArgs = append(buildArgs, "--secret", secret)
+		}
+		for _, ssh := range options.SSH {
+			buildArgs = append(buildArgs, "--ssh", ssh)
+		}
+		for _, context := range options.Contexts {
+			if name, value, local := namedContext(context); local {
+				buildArgs = append(buildArgs, "--local", name+"="+value, "--opt", "context:"+name+"=local:"+name)
+			} else {
+				buildArgs = append(buildArgs, "--opt", "context:"+name+"="+value)
 			}
-			if options.Target != "" {
-				buildArgs = append(buildArgs, "--opt", "target="+options.Target)
+		}
+		if options.Platform != "" {
+			buildArgs = append(buildArgs, "--opt", "platform="+options.Platform)
+		}
+		if options.NoCache {
+			buildArgs = append(buildArgs, "--no-cache")
+		}
+		if push {
+			output := "type=image,name=" + image + ",push=true"
+			if strings.HasPrefix(image, "localhost:") {
+				output += ",registry.insecure=true"
 			}
+			buildArgs = append(buildArgs, "--output", output)
+		} else {
 			buildArgs = append(buildArgs, "--output", "type=image,name="+image+",unpack=true")
-		} else /* if d != nil */ {
-			buildArgs = []string{
-				"--host", "localhost:" + builderPort,
-				"build",
-			}
-			if options.File != "" {
-				buildArgs = append(buildArgs, "--file", options.File)
-			}
-			for _, arg := range options.Args {
-				buildArgs = append(buildArgs, "--build-arg", arg)
-			}
-			if options.Target != "" {
-				buildArgs = append(buildArgs, "--target", options.Target)
-			}
-			buildArgs = append(buildArgs, "--tag", image, context)
 		}
+	} else /* if d != nil */ {
+		if addr != "" {
+			buildArgs = []string{"--host", addr}
+		}
+		if rawjson {
+			buildArgs = append(buildArgs, "buildx", "build", "--progress", "rawjson", "--load")
+		} else {
+			buildArgs = append(buildArgs, "build")
+		}
+		if options.File != "" {
+			buildArgs = append(buildArgs, "--file", options.File)
+		}
+		for _, arg := range options.Args {
+			buildArgs = append(buildArgs, "--build-arg", arg)
+		}
+		if options.Target != "" {
+			buildArgs = append(buildArgs, "--target", options.Target)
+		}
+		for _, secret := range options.Secrets {
+			buildArgs = append(buildArgs, "--secret", secret)
+		}
+		for _, ssh := range options.SSH {
+			buildArgs = append(buildArgs, "--ssh", ssh)
+		}
+		for _, context := range options.Contexts {
+			buildArgs = append(buildArgs, "--build-context", context)
+		}
+		if options.Platform != "" {
+			buildArgs = append(buildArgs, "--platform", options.Platform)
+		}
+		if options.NoCache {
+			buildArgs = append(buildArgs, "--no-cache")
+		}
+		buildArgs = append(buildArgs, "--tag", image, context)
+	}
 
-		op.Progress("running")
-		if bc != nil {
-			re := regexp.MustCompile(`^#[0-9]+\s(\[.*)$`)
-			return bc.EachErrLine(buildArgs, func(line string) {
-				if out.Level < output.LevelVerbose {
-					if matches := re.FindStringSubmatch(line); len(matches) > 0 {
-						op.Progress(matches[1])
-					}
-				} else {
-					out.Verbose("[buildctl] %s", line)
-				}
-			})
+	op.Progress("running")
+	if bc != nil {
+		p := newProgress("buildctl", op, out)
+		return p.err(bc.EachErrLine(buildArgs, p.line))
+	}
+
+	readline := func(line string) {
+		if out.Level < output.LevelVerbose && (strings.HasPrefix(line, "Sending build context ") || strings.HasPrefix(line, "Step ")) {
+			op.Progress("s" + line[1:])
 		} else {
-			return d.EachLine(buildArgs, func(line string) {
-				if out.Level < output.LevelVerbose && (strings.HasPrefix(line, "Sending build context ") || strings.HasPrefix(line, "Step ")) {
-					op.Progress("s" + line[1:])
-				} else {
-					out.Verbose("[docker] %s", line)
-				}
-			})
+			out.Verbose("[docker] %s", line)
 		}
-	}))
+	}
+	if rawjson {
+		p := newProgress("docker", op, out)
+		if err := p.err(d.EachErrLine(buildArgs, p.line)); err != nil || !push {
+			return err
+		}
+	} else if err := d.EachLine(buildArgs, readline); err != nil || !push {
+		return err
+	}
+
+	op.Progress("pushing")
+	return d.EachLine([]string{"push", image}, readline)
 }
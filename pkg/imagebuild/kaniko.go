@@ -0,0 +1,203 @@
+package imagebuild
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/stepro/kdo/pkg/kubectl"
+	"github.com/stepro/kdo/pkg/output"
+)
+
+// KanikoOptions represents options for building images in a kaniko pod
+type KanikoOptions struct {
+	// Image is the kaniko executor image, which must include a shell
+	Image string
+	// Secret is the name of a secret of type kubernetes.io/dockerconfigjson
+	// that contains the credentials used to push to the registry
+	Secret string
+	// Insecure indicates that the registry is accessed over plain HTTP
+	Insecure bool
+}
+
+// kanikoDockerfile is the name under which the dockerfile is added to
+// the build context, as it may be outside of or excluded from it
+const kanikoDockerfile = ".kdo-dockerfile"
+
+// BuildInCluster builds an image in an unprivileged kaniko pod
+// from a build context streamed to it, and pushes it to a registry
+func BuildInCluster(k kubectl.CLI, pod string, kaniko *KanikoOptions, options *Options, image string, context string, out *output.Interface) error {
+	if len(options.Secrets) > 0 || len(options.SSH) > 0 || len(options.Contexts) > 0 {
+		return pkgerror(errors.New("kaniko does not support build secrets, SSH or additional build contexts"))
+	}
+
+	return pkgerror(out.Do("Building image", func(op output.Operation) error {
+		args := []string{
+			"--context=tar://stdin",
+			"--dockerfile=" + kanikoDockerfile,
+			"--destination=" + image,
+			"--cache=" + strconv.FormatBool(!options.NoCache),
+			"--log-format=text",
+			"--log-timestamp=false",
+		}
+		for _, arg := range options.Args {
+			args = append(args, "--build-arg="+arg)
+		}
+		if options.Target != "" {
+			args = append(args, "--target="+options.Target)
+		}
+		if options.Platform != "" {
+			args = append(args, "--custom-platform="+options.Platform)
+		}
+		if kaniko.Insecure {
+			args = append(args, "--insecure-registry="+image[:strings.Index(image, "/")])
+		}
+
+		container := map[string]interface{}{
+			"name":      pod,
+			"image":     kaniko.Image,
+			"stdin":     true,
+			"stdinOnce": true,
+			// Merge the log output into the standard output
+			"command": append([]string{"/busybox/sh", "-c", `exec /kaniko/executor "$@" 2>&1`, "--"}, args...),
+		}
+		spec := map[string]interface{}{
+			"containers":    []interface{}{container},
+			"restartPolicy": "Never",
+			"nodeSelector": map[string]interface{}{
+				"kubernetes.io/os": "linux",
+			},
+		}
+		if kaniko.Secret != "" {
+			spec["volumes"] = []interface{}{
+				map[string]interface{}{
+					"name": "kdo-registry-credentials",
+					"secret": map[string]interface{}{
+						"secretName": kaniko.Secret,
+						"items": []interface{}{
+							map[string]interface{}{
+								"key":  ".dockerconfigjson",
+								"path": "config.json",
+							},
+						},
+					},
+				},
+			}
+			container["volumeMounts"] = []interface{}{
+				map[string]interface{}{
+					"name":      "kdo-registry-credentials",
+					"mountPath": "/kaniko/.docker",
+				},
+			}
+		}
+		overrides, err := json.Marshal(map[string]interface{}{
+			"apiVersion": "v1",
+			"spec":       spec,
+		})
+		if err != nil {
+			return err
+		}
+
+		r, w := io.Pipe()
+		go func() {
+			w.CloseWithError(archive(w, context, options))
+		}()
+		defer r.Close()
+
+		stdout := output.NewLineWriter(func(line string) {
+			if out.Level < output.LevelVerbose {
+				if msg := kanikoMessage(line); msg != "" {
+					op.Progress(msg)
+				}
+			} else {
+				out.Verbose("[kaniko] %s", line)
+			}
+		})
+		defer stdout.Close()
+
+		op.Progress("starting build pod")
+		return k.Pipe(r, stdout, "run", pod, "--image", kaniko.Image, "--restart", "Never",
+			"--rm", "--stdin", "--quiet", "--overrides", string(overrides))
+	}))
+}
+
+// kanikoMessage gets the message of an informational log line
+func kanikoMessage(line string) string {
+	if !strings.HasPrefix(line, "level=info ") {
+		return ""
+	}
+	i := strings.Index(line, "msg=")
+	if i < 0 {
+		return ""
+	}
+	msg := line[i+4:]
+	if unquoted, err := strconv.Unquote(msg); err == nil {
+		msg = unquoted
+	}
+	return msg
+}
+
+// archive writes a compressed tar archive of the files in
+// a build context that are not excluded by its .dockerignore
+// file, along with the dockerfile, in the form kaniko expects
+func archive(w io.Writer, context string, options *Options) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+
+	add := func(path string, name string, info os.FileInfo) error {
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			var err error
+			if link, err = os.Readlink(name); err != nil {
+				return err
+			}
+		} else if !info.Mode().IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = path
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	}
+
+	file := dockerfile(context, options)
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if err = add(kanikoDockerfile, file, info); err != nil {
+		return err
+	}
+
+	if err = walk(context, add); err != nil {
+		return err
+	}
+
+	if err = tw.Close(); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
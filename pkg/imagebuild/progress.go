@@ -0,0 +1,146 @@
+package imagebuild
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/stepro/kdo/pkg/output"
+)
+
+// solveStatus is the subset of a buildkit solve status
+// that is output as a line of JSON by rawjson progress
+type solveStatus struct {
+	Vertexes []vertex    `json:"vertexes"`
+	Logs     []vertexLog `json:"logs"`
+}
+
+type vertex struct {
+	Digest    string     `json:"digest"`
+	Name      string     `json:"name"`
+	Started   *time.Time `json:"started"`
+	Completed *time.Time `json:"completed"`
+	Cached    bool       `json:"cached"`
+	Error     string     `json:"error"`
+}
+
+type vertexLog struct {
+	Vertex string `json:"vertex"`
+	Data   []byte `json:"data"`
+}
+
+// logTail is the number of log lines kept for each step
+const logTail = 10
+
+// step represents the latest state of a build step
+type step struct {
+	vertex
+	logs    []string
+	partial string
+	done    bool
+}
+
+// progress decodes rawjson progress into build steps
+// that drive the progress of an operation
+type progress struct {
+	label  string
+	op     output.Operation
+	out    *output.Interface
+	steps  map[string]*step
+	failed *step
+	cached int
+	ran    int
+}
+
+func newProgress(label string, op output.Operation, out *output.Interface) *progress {
+	return &progress{
+		label: label,
+		op:    op,
+		out:   out,
+		steps: map[string]*step{},
+	}
+}
+
+// line processes a line of output, which is either
+// a solve status or, if it cannot be decoded, text
+func (p *progress) line(line string) {
+	var status solveStatus
+	if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &status) != nil {
+		p.out.Verbose("[%s] %s", p.label, line)
+		return
+	}
+
+	for _, v := range status.Vertexes {
+		s := p.steps[v.Digest]
+		if s == nil {
+			s = &step{}
+			p.steps[v.Digest] = s
+		}
+		s.vertex = v
+		if s.done {
+			continue
+		}
+		switch {
+		case v.Error != "":
+			s.done = true
+			if p.failed == nil && !strings.HasSuffix(v.Error, "context canceled") {
+				p.failed = s
+			}
+		case v.Cached:
+			s.done = true
+			p.cached++
+			p.out.Verbose("[%s] %s: cached", p.label, v.Name)
+		case v.Completed != nil:
+			s.done = true
+			p.ran++
+			var duration time.Duration
+			if v.Started != nil {
+				duration = v.Completed.Sub(*v.Started)
+			}
+			p.out.Verbose("[%s] %s: %.1fs", p.label, v.Name, duration.Seconds())
+		case v.Started != nil:
+			p.op.Progress("%s", v.Name)
+		}
+	}
+
+	for _, l := range status.Logs {
+		s := p.steps[l.Vertex]
+		if s == nil {
+			continue
+		}
+		lines := strings.Split(s.partial+string(l.Data), "\n")
+		s.partial = lines[len(lines)-1]
+		for _, line := range lines[:len(lines)-1] {
+			line = strings.TrimRight(line, "\r")
+			p.out.Debug("[%s] %s", p.label, line)
+			s.logs = append(s.logs, line)
+			if len(s.logs) > logTail {
+				s.logs = s.logs[1:]
+			}
+		}
+	}
+}
+
+// err reports a build error, replacing it with the error
+// of the failed step, if any, followed by the tail of its log
+func (p *progress) err(err error) error {
+	if err == nil {
+		p.out.Verbose("[%s] %d steps ran, %d steps cached", p.label, p.ran, p.cached)
+		return nil
+	} else if p.failed == nil {
+		return err
+	}
+
+	logs := p.failed.logs
+	if p.failed.partial != "" {
+		logs = append(logs, p.failed.partial)
+	}
+	msg := fmt.Sprintf("%s: %s", p.failed.Name, p.failed.Error)
+	if len(logs) > 0 {
+		msg += "\n" + strings.Join(logs, "\n")
+	}
+
+	return errors.New(msg)
+}
@@ -24,6 +24,9 @@ type CLI interface {
 	Run(arg ...string) error
 	// Input runs a kubectl command with input
 	Input(input io.Reader, arg ...string) error
+	// Pipe runs a kubectl command with input and output
+	// streams, without waiting for input to be exhausted
+	Pipe(input io.Reader, output io.Writer, arg ...string) error
 	// String runs a kubectl command that outputs a string
 	String(arg ...string) (string, error)
 	// ErrorString runs a kubectl command that outputs an error string
@@ -75,6 +78,20 @@ func (k *cli) Input(input io.Reader, arg ...string) error {
 	return command.Run(cmd, k.out, k.verb)
 }
 
+func (k *cli) Pipe(input io.Reader, output io.Writer, arg ...string) error {
+	cmd := k.command(arg...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	go func() {
+		io.Copy(stdin, input)
+		stdin.Close()
+	}()
+	cmd.Stdout = output
+	return command.Run(cmd, k.out, k.verb)
+}
+
 func (k *cli) String(arg ...string) (string, error) {
 	return command.String(k.command(arg...), k.out, k.verb)
 }
@@ -0,0 +1,389 @@
+package kubectl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/stepro/kdo/pkg/output"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+)
+
+// exitError represents a command that ran to completion
+// but failed with an exit code, as the kubectl CLI would
+type exitError struct {
+	code int
+	msg  string
+}
+
+func (e *exitError) Error() string {
+	return e.msg
+}
+
+// ExitCode gets the exit code kubectl would have returned
+func (e *exitError) ExitCode() int {
+	return e.code
+}
+
+// errNoMatch is reported when a selector matches no resources
+var errNoMatch = errors.New("no matching resources found")
+
+// IsNotFound indicates if an error reported by the native
+// implementation was caused by a missing resource or by
+// a selector that did not match any resources
+func IsNotFound(err error) bool {
+	return apierrors.IsNotFound(err) || errors.Is(err, errNoMatch)
+}
+
+var initNative sync.Once
+
+type native struct {
+	opt  *Options
+	out  *output.Interface
+	verb output.Level
+
+	init      sync.Once
+	initErr   error
+	config    *rest.Config
+	namespace string
+	clientset kubernetes.Interface
+	dynamic   dynamic.Interface
+	mapper    meta.RESTMapper
+}
+
+// initialize loads the client configuration and creates
+// the clients the first time a command needs them
+func (k *native) initialize() error {
+	k.init.Do(func() {
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		rules.ExplicitPath = k.opt.Kubeconfig
+		overrides := &clientcmd.ConfigOverrides{
+			CurrentContext: k.opt.Context,
+		}
+		overrides.Context.Namespace = k.opt.Namespace
+		config := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides)
+
+		if k.config, k.initErr = config.ClientConfig(); k.initErr != nil {
+			return
+		} else if k.namespace, _, k.initErr = config.Namespace(); k.initErr != nil {
+			return
+		} else if k.clientset, k.initErr = kubernetes.NewForConfig(k.config); k.initErr != nil {
+			return
+		} else if k.dynamic, k.initErr = dynamic.NewForConfig(k.config); k.initErr != nil {
+			return
+		}
+
+		discovery := memory.NewMemCacheClient(k.clientset.Discovery())
+		k.mapper = restmapper.NewShortcutExpander(restmapper.NewDeferredDiscoveryRESTMapper(discovery), discovery)
+	})
+
+	return k.initErr
+}
+
+// commandLine represents a parsed kubectl command line
+type commandLine struct {
+	verb  string
+	args  []string
+	flags map[string]string
+	// exec is the command following a "--" argument
+	exec []string
+}
+
+// nativeFlags are the flags the native implementation
+// understands, mapped to whether they take a value
+var nativeFlags = map[string]bool{
+	"all-namespaces":   false,
+	"container":        true,
+	"filename":         true,
+	"follow":           false,
+	"for":              true,
+	"ignore-not-found": false,
+	"image":            true,
+	"namespace":        true,
+	"output":           true,
+	"overrides":        true,
+	"overwrite":        false,
+	"quiet":            false,
+	"raw":              true,
+	"restart":          true,
+	"rm":               false,
+	"selector":         true,
+	"stdin":            false,
+	"subresource":      true,
+	"tty":              false,
+	"wait":             false,
+}
+
+var shortFlags = map[string]string{
+	"A": "all-namespaces",
+	"c": "container",
+	"f": "filename",
+	"i": "stdin",
+	"l": "selector",
+	"n": "namespace",
+	"o": "output",
+	"t": "tty",
+}
+
+func parse(arg []string) (*commandLine, error) {
+	c := &commandLine{
+		flags: map[string]string{},
+	}
+
+	for i := 0; i < len(arg); i++ {
+		a := arg[i]
+		switch {
+		case a == "--":
+			c.exec = arg[i+1:]
+			i = len(arg)
+		case len(a) > 1 && a[0] == '-':
+			name := strings.TrimLeft(a, "-")
+			value, hasValue := "", false
+			if j := strings.Index(name, "="); j >= 0 {
+				name, value, hasValue = name[:j], name[j+1:], true
+			}
+			if !strings.HasPrefix(a, "--") {
+				name = shortFlags[name]
+			}
+			takesValue, ok := nativeFlags[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown flag: %s", a)
+			}
+			if !hasValue {
+				if !takesValue {
+					value = "true"
+				} else if i++; i < len(arg) {
+					value = arg[i]
+				} else {
+					return nil, fmt.Errorf("flag needs an argument: %s", a)
+				}
+			}
+			c.flags[name] = value
+		case c.verb == "":
+			c.verb = a
+		default:
+			c.args = append(c.args, a)
+		}
+	}
+
+	if c.verb == "" {
+		return nil, errors.New("no command specified")
+	}
+
+	return c, nil
+}
+
+// bool gets the value of a boolean flag
+func (c *commandLine) bool(name string, value bool) bool {
+	if s, ok := c.flags[name]; ok {
+		value, _ = strconv.ParseBool(s)
+	}
+	return value
+}
+
+// namespaceOf gets the namespace that a command targets,
+// which is empty when it targets all namespaces
+func (k *native) namespaceOf(c *commandLine) string {
+	if c.bool("all-namespaces", false) {
+		return ""
+	} else if namespace := c.flags["namespace"]; namespace != "" {
+		return namespace
+	}
+	return k.namespace
+}
+
+func (k *native) run(ctx context.Context, stdin io.Reader, stdout io.Writer, stderr io.Writer, arg ...string) (err error) {
+	if stdout == nil {
+		s := k.out.NewStream("kubectl", k.verb, false)
+		defer s.Close()
+		stdout = s
+	}
+	if stderr == nil {
+		s := k.out.NewStream("kubectl", k.verb, true)
+		defer s.Close()
+		stderr = s
+	}
+
+	argstring := "kubectl " + strings.Join(arg, " ")
+	k.out.Debug("running: %s", argstring)
+	defer func() {
+		if err != nil {
+			k.out.Debug("failed: %s", argstring)
+		} else {
+			k.out.Debug("completed: %s", argstring)
+		}
+	}()
+
+	c, err := parse(arg)
+	if err != nil {
+		return fmt.Errorf("kubectl: %v", err)
+	} else if err = k.initialize(); err != nil {
+		return fmt.Errorf("kubectl: %w", err)
+	}
+
+	switch c.verb {
+	case "annotate":
+		err = k.annotate(ctx, c, stdout)
+	case "apply":
+		err = k.apply(ctx, c, stdin, stdout)
+	case "attach":
+		err = k.attach(ctx, c, stdin, stdout, stderr)
+	case "auth":
+		err = k.auth(ctx, c, stdout)
+	case "delete":
+		err = k.delete(ctx, c, stdout)
+	case "exec":
+		err = k.exec(ctx, c, stdin, stdout, stderr)
+	case "get":
+		err = k.get(ctx, c, stdout)
+	case "logs":
+		err = k.logs(ctx, c, stdout)
+	case "port-forward":
+		err = k.portForward(ctx, c, stdout, stderr)
+	case "rollout":
+		err = k.rollout(ctx, c, stdout)
+	case "run":
+		err = k.runPod(ctx, c, stdin, stdout, stderr)
+	case "version":
+		err = k.version(ctx, c, stdout)
+	case "wait":
+		err = k.wait(ctx, c)
+	default:
+		err = fmt.Errorf(`unsupported command "%s"`, c.verb)
+	}
+
+	if _, ok := err.(*exitError); err != nil && !ok {
+		err = fmt.Errorf("kubectl %s: %w", c.verb, err)
+	}
+
+	return
+}
+
+func (k *native) Run(arg ...string) error {
+	return k.run(context.Background(), nil, nil, nil, arg...)
+}
+
+func (k *native) Input(input io.Reader, arg ...string) error {
+	return k.run(context.Background(), input, nil, nil, arg...)
+}
+
+func (k *native) Pipe(input io.Reader, output io.Writer, arg ...string) error {
+	return k.run(context.Background(), input, output, nil, arg...)
+}
+
+func (k *native) String(arg ...string) (string, error) {
+	stdout := &bytes.Buffer{}
+	if err := k.run(context.Background(), nil, stdout, nil, arg...); err != nil {
+		return "", err
+	}
+
+	return strings.ReplaceAll(stdout.String(), "\r\n", "\n"), nil
+}
+
+func (k *native) ErrorString(arg ...string) (string, error) {
+	stderr := &bytes.Buffer{}
+	if err := k.run(context.Background(), nil, nil, stderr, arg...); err != nil {
+		if _, ok := err.(*exitError); ok {
+			return stderr.String(), err
+		}
+		return err.Error(), err
+	}
+
+	return "", nil
+}
+
+func (k *native) Lines(arg ...string) ([]string, error) {
+	stdout := &bytes.Buffer{}
+	if err := k.run(context.Background(), nil, stdout, nil, arg...); err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	return lines, nil
+}
+
+func (k *native) StartLines(args []string, fn func(line string), end chan error) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	stdout := output.NewLineWriter(fn)
+
+	go func() {
+		err := k.run(ctx, nil, stdout, nil, args...)
+		stdout.Close()
+		if end != nil {
+			select {
+			case end <- err:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	return cancel
+}
+
+func (k *native) Exec(arg ...string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Ensure Ctrl+C cancels the command
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	defer signal.Stop(signals)
+
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := k.run(ctx, &stdinReader{ctx: ctx}, os.Stdout, os.Stderr, arg...); err != nil {
+		if ctx.Err() != nil {
+			return &exitError{code: 130, msg: "interrupted"}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// NewNative creates a new kubectl CLI object that implements
+// the kubectl commands used by kdo in-process using the
+// Kubernetes client libraries instead of a kubectl binary
+func NewNative(options *Options, out *output.Interface, verb output.Level) CLI {
+	initNative.Do(func() {
+		if options.Verbosity != 0 {
+			flags := flag.NewFlagSet("klog", flag.ContinueOnError)
+			klog.InitFlags(flags)
+			flags.Set("v", strconv.Itoa(options.Verbosity))
+		}
+	})
+
+	return &native{
+		opt:  options,
+		out:  out,
+		verb: verb,
+	}
+}
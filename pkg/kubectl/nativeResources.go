@@ -0,0 +1,591 @@
+package kubectl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/cli-runtime/pkg/printers"
+	"k8s.io/client-go/dynamic"
+)
+
+// target is a type of resource and, optionally, a resource name
+type target struct {
+	mapping *meta.RESTMapping
+	name    string
+}
+
+// mapping resolves a resource type in any of the forms
+// accepted by kubectl, such as "deploy" or "jobs.batch"
+func (k *native) mapping(resource string) (*meta.RESTMapping, error) {
+	gvr, gr := schema.ParseResourceArg(strings.ToLower(resource))
+
+	var gvk schema.GroupVersionKind
+	var err error
+	if gvr != nil {
+		gvk, err = k.mapper.KindFor(*gvr)
+	}
+	if gvk.Empty() {
+		if gvk, err = k.mapper.KindFor(gr.WithVersion("")); err != nil {
+			return nil, err
+		}
+	}
+
+	return k.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+}
+
+// targets resolves resource arguments in the form "type[,type] [name...]"
+// or "type/name...", where a type without a name targets all resources
+func (k *native) targets(args []string) ([]target, error) {
+	if len(args) == 0 {
+		return nil, errors.New("no resource type specified")
+	}
+
+	var targets []target
+	if strings.Contains(args[0], "/") {
+		for _, arg := range args {
+			typeName := strings.SplitN(arg, "/", 2)
+			if len(typeName) != 2 || typeName[1] == "" {
+				return nil, fmt.Errorf(`"%s" is not in the form type/name`, arg)
+			}
+			mapping, err := k.mapping(typeName[0])
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, target{mapping, typeName[1]})
+		}
+		return targets, nil
+	}
+
+	for _, resource := range strings.Split(args[0], ",") {
+		mapping, err := k.mapping(resource)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 1 {
+			targets = append(targets, target{mapping: mapping})
+		}
+		for _, name := range args[1:] {
+			targets = append(targets, target{mapping, name})
+		}
+	}
+
+	return targets, nil
+}
+
+// resource gets a client for a type of resource in a namespace,
+// where an empty namespace lists resources in all namespaces
+func (k *native) resource(mapping *meta.RESTMapping, namespace string) dynamic.ResourceInterface {
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		return k.dynamic.Resource(mapping.Resource).Namespace(namespace)
+	}
+	return k.dynamic.Resource(mapping.Resource)
+}
+
+// typeName gets the name of a resource as kubectl prints it
+func typeName(mapping *meta.RESTMapping, name string) string {
+	kind := strings.ToLower(mapping.GroupVersionKind.Kind)
+	if group := mapping.GroupVersionKind.Group; group != "" {
+		kind += "." + group
+	}
+	return kind + "/" + name
+}
+
+// list lists the resources of a target that match a selector
+func (k *native) list(ctx context.Context, t target, namespace string, selector string) ([]unstructured.Unstructured, error) {
+	list, err := k.resource(t.mapping, namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: selector,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (k *native) get(ctx context.Context, c *commandLine, stdout io.Writer) error {
+	if raw := c.flags["raw"]; raw != "" {
+		// A watch streams until the context is cancelled
+		stream, err := k.clientset.CoreV1().RESTClient().Get().RequestURI(raw).Stream(ctx)
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+		if _, err = io.Copy(stdout, stream); err != nil && ctx.Err() == nil {
+			return err
+		}
+		return nil
+	}
+
+	targets, err := k.targets(c.args)
+	if err != nil {
+		return err
+	}
+
+	namespace := k.namespaceOf(c)
+	var items []interface{}
+	var names []string
+	for _, t := range targets {
+		if t.name != "" {
+			obj, err := k.resource(t.mapping, namespace).Get(ctx, t.name, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) && c.bool("ignore-not-found", false) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if len(targets) == 1 {
+				return printObject(obj.Object, c.flags["output"], []string{typeName(t.mapping, t.name)}, stdout)
+			}
+			items = append(items, obj.Object)
+			names = append(names, typeName(t.mapping, t.name))
+			continue
+		}
+
+		list, err := k.list(ctx, t, namespace, c.flags["selector"])
+		if err != nil {
+			return err
+		}
+		for _, item := range list {
+			items = append(items, item.Object)
+			names = append(names, typeName(t.mapping, item.GetName()))
+		}
+	}
+	if items == nil {
+		items = []interface{}{}
+	}
+
+	return printObject(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "List",
+		"metadata":   map[string]interface{}{},
+		"items":      items,
+	}, c.flags["output"], names, stdout)
+}
+
+// printObject prints an object in an output format
+func printObject(obj map[string]interface{}, format string, names []string, w io.Writer) error {
+	switch {
+	case format == "json":
+		data, err := json.MarshalIndent(obj, "", "    ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	case strings.HasPrefix(format, "go-template="):
+		printer, err := printers.NewGoTemplatePrinter([]byte(format[len("go-template="):]))
+		if err != nil {
+			return err
+		}
+		printer.AllowMissingKeys(true)
+		return printer.PrintObj(&unstructured.Unstructured{Object: obj}, w)
+	case format == "" || format == "name":
+		for _, name := range names {
+			if _, err := fmt.Fprintln(w, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf(`unsupported output format "%s"`, format)
+}
+
+func (k *native) apply(ctx context.Context, c *commandLine, stdin io.Reader, stdout io.Writer) error {
+	if c.flags["filename"] != "-" || stdin == nil {
+		return errors.New("only --filename - is supported")
+	}
+
+	var objs []*unstructured.Unstructured
+	reader := yaml.NewYAMLReader(bufio.NewReader(stdin))
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		data, err := yaml.ToJSON(doc)
+		if err != nil {
+			return err
+		} else if data = bytes.TrimSpace(data); len(data) == 0 || string(data) == "null" {
+			continue
+		}
+		obj, _, err := unstructured.UnstructuredJSONScheme.Decode(data, nil, nil)
+		if err != nil {
+			return err
+		}
+		switch obj := obj.(type) {
+		case *unstructured.Unstructured:
+			objs = append(objs, obj)
+		case *unstructured.UnstructuredList:
+			for i := range obj.Items {
+				objs = append(objs, &obj.Items[i])
+			}
+		}
+	}
+
+	// Server-side apply takes ownership of fields set by other managers
+	force := true
+	for _, obj := range objs {
+		gvk := obj.GroupVersionKind()
+		mapping, err := k.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			return err
+		}
+		namespace := ""
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			if namespace = obj.GetNamespace(); namespace == "" {
+				namespace = k.namespaceOf(c)
+				obj.SetNamespace(namespace)
+			}
+		}
+		data, err := obj.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		if _, err = k.resource(mapping, namespace).Patch(ctx, obj.GetName(), types.ApplyPatchType, data, metav1.PatchOptions{
+			FieldManager: "kdo",
+			Force:        &force,
+		}); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%s applied\n", typeName(mapping, obj.GetName()))
+	}
+
+	return nil
+}
+
+// deleted identifies a resource that is being deleted
+type deleted struct {
+	mapping  *meta.RESTMapping
+	resource dynamic.ResourceInterface
+	name     string
+	uid      types.UID
+}
+
+// await waits until a resource being deleted is gone
+func (d *deleted) await(ctx context.Context) error {
+	for {
+		obj, err := d.resource.Get(ctx, d.name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) || err == nil && obj.GetUID() != d.uid {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		w, err := d.resource.Watch(ctx, metav1.ListOptions{
+			FieldSelector:   fields.OneTermEqualSelector("metadata.name", d.name).String(),
+			ResourceVersion: obj.GetResourceVersion(),
+		})
+		if err != nil {
+			return err
+		}
+		gone := false
+		for event := range w.ResultChan() {
+			if event.Type == watch.Deleted {
+				gone = true
+				break
+			} else if event.Type == watch.Error {
+				break
+			}
+		}
+		w.Stop()
+		if gone {
+			return nil
+		} else if err = ctx.Err(); err != nil {
+			return err
+		}
+		// The watch ended early, so check again
+	}
+}
+
+// find finds the resources of targets, which are named
+// or match a selector, ignoring missing named resources
+// if requested, and otherwise reporting them as errors
+func (k *native) find(ctx context.Context, c *commandLine, ignoreNotFound bool) ([]deleted, error) {
+	targets, err := k.targets(c.args)
+	if err != nil {
+		return nil, err
+	}
+
+	namespace := k.namespaceOf(c)
+	selector := c.flags["selector"]
+	var found []deleted
+	for _, t := range targets {
+		if t.name != "" {
+			resource := k.resource(t.mapping, namespace)
+			obj, err := resource.Get(ctx, t.name, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) && ignoreNotFound {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			found = append(found, deleted{t.mapping, resource, t.name, obj.GetUID()})
+			continue
+		} else if selector == "" {
+			return nil, errors.New("no resource name or selector specified")
+		}
+
+		items, err := k.list(ctx, t, namespace, selector)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			found = append(found, deleted{t.mapping, k.resource(t.mapping, item.GetNamespace()), item.GetName(), item.GetUID()})
+		}
+	}
+
+	return found, nil
+}
+
+func (k *native) delete(ctx context.Context, c *commandLine, stdout io.Writer) error {
+	found, err := k.find(ctx, c, c.bool("ignore-not-found", false))
+	if err != nil {
+		return err
+	}
+
+	policy := metav1.DeletePropagationBackground
+	for _, d := range found {
+		uid := d.uid
+		err := d.resource.Delete(ctx, d.name, metav1.DeleteOptions{
+			PropagationPolicy: &policy,
+			Preconditions:     &metav1.Preconditions{UID: &uid},
+		})
+		if apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+			// The resource was deleted in the meantime
+			continue
+		} else if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%s deleted\n", typeName(d.mapping, d.name))
+	}
+
+	if c.bool("wait", true) {
+		for _, d := range found {
+			if err = d.await(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (k *native) wait(ctx context.Context, c *commandLine) error {
+	if c.flags["for"] != "delete" {
+		return fmt.Errorf(`unsupported condition "%s"`, c.flags["for"])
+	}
+
+	found, err := k.find(ctx, c, false)
+	if err != nil {
+		return err
+	} else if len(found) == 0 {
+		return errNoMatch
+	}
+
+	for _, d := range found {
+		if err = d.await(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (k *native) annotate(ctx context.Context, c *commandLine, stdout io.Writer) error {
+	var resourceArgs []string
+	annotations := map[string]interface{}{}
+	for _, arg := range c.args {
+		if i := strings.Index(arg, "="); i >= 0 {
+			annotations[arg[:i]] = arg[i+1:]
+		} else if strings.HasSuffix(arg, "-") {
+			annotations[strings.TrimSuffix(arg, "-")] = nil
+		} else {
+			resourceArgs = append(resourceArgs, arg)
+		}
+	}
+	targets, err := k.targets(resourceArgs)
+	if err != nil {
+		return err
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	namespace := k.namespaceOf(c)
+	for _, t := range targets {
+		if t.name == "" {
+			return errors.New("no resource name specified")
+		}
+		resource := k.resource(t.mapping, namespace)
+		if !c.bool("overwrite", false) {
+			obj, err := resource.Get(ctx, t.name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			for key, value := range annotations {
+				if existing, ok := obj.GetAnnotations()[key]; ok && value != nil && existing != value {
+					return fmt.Errorf("annotation %s already has a value (%s), and --overwrite is false", key, existing)
+				}
+			}
+		}
+		if _, err = resource.Patch(ctx, t.name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%s annotated\n", typeName(t.mapping, t.name))
+	}
+
+	return nil
+}
+
+func (k *native) rollout(ctx context.Context, c *commandLine, stdout io.Writer) error {
+	if len(c.args) != 2 || c.args[0] != "undo" {
+		return errors.New("only rollout undo is supported")
+	}
+	targets, err := k.targets(c.args[1:])
+	if err != nil {
+		return err
+	} else if len(targets) != 1 || targets[0].name == "" ||
+		targets[0].mapping.Resource.GroupResource() != appsv1.Resource("daemonsets") {
+		return errors.New("rollout undo is only supported for a named daemon set")
+	}
+
+	// Roll back to the revision before the current one,
+	// which is how kubectl rolls back a daemon set
+	namespace, name := k.namespaceOf(c), targets[0].name
+	daemonSets := k.clientset.AppsV1().DaemonSets(namespace)
+	ds, err := daemonSets.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	selector, err := metav1.LabelSelectorAsSelector(ds.Spec.Selector)
+	if err != nil {
+		return err
+	}
+	revisions, err := k.clientset.AppsV1().ControllerRevisions(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return err
+	}
+	var history []*appsv1.ControllerRevision
+	for i := range revisions.Items {
+		if metav1.IsControlledBy(&revisions.Items[i], ds) {
+			history = append(history, &revisions.Items[i])
+		}
+	}
+	if len(history) < 2 {
+		return fmt.Errorf("no previous revision of daemonset %s", name)
+	}
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].Revision < history[j].Revision
+	})
+
+	if _, err = daemonSets.Patch(ctx, name, types.StrategicMergePatchType, history[len(history)-2].Data.Raw, metav1.PatchOptions{}); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s rolled back\n", typeName(targets[0].mapping, name))
+
+	return nil
+}
+
+// clientVersion gets the Kubernetes version that matches the
+// version of the client libraries this binary was built with
+func clientVersion() *version.Info {
+	info := &version.Info{
+		GitVersion: "unknown",
+		GoVersion:  runtime.Version(),
+		Compiler:   runtime.Compiler,
+		Platform:   runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range build.Deps {
+			if dep.Path == "k8s.io/client-go" {
+				// Client libraries v0.N.M ship with Kubernetes v1.N.M
+				info.GitVersion = "v1" + strings.TrimPrefix(dep.Version, "v0")
+			}
+		}
+	}
+	return info
+}
+
+func (k *native) version(ctx context.Context, c *commandLine, stdout io.Writer) error {
+	if c.flags["output"] != "json" {
+		return errors.New("only --output json is supported")
+	}
+
+	serverVersion, err := k.clientset.Discovery().ServerVersion()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"clientVersion": clientVersion(),
+		"serverVersion": serverVersion,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(stdout, "%s\n", data)
+	return err
+}
+
+func (k *native) auth(ctx context.Context, c *commandLine, stdout io.Writer) error {
+	if len(c.args) != 3 || c.args[0] != "can-i" {
+		return errors.New("only auth can-i is supported")
+	}
+
+	verb, resource := c.args[1], c.args[2]
+	gr := schema.ParseGroupResource(resource)
+	if mapping, err := k.mapping(resource); err == nil {
+		gr = mapping.Resource.GroupResource()
+	}
+
+	review, err := k.clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   k.namespaceOf(c),
+				Verb:        verb,
+				Group:       gr.Group,
+				Resource:    gr.Resource,
+				Subresource: c.flags["subresource"],
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	} else if !review.Status.Allowed {
+		// Like kubectl, a denial fails without an error message
+		fmt.Fprintln(stdout, "no")
+		return &exitError{code: 1, msg: "kubectl auth can-i: no"}
+	}
+
+	_, err = fmt.Fprintln(stdout, "yes")
+	return err
+}
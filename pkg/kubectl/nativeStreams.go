@@ -0,0 +1,473 @@
+package kubectl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/transport/spdy"
+	utilexec "k8s.io/client-go/util/exec"
+	"k8s.io/kubectl/pkg/util/interrupt"
+	"k8s.io/kubectl/pkg/util/term"
+)
+
+var stdin struct {
+	once sync.Once
+	data chan []byte
+	err  error
+}
+
+// stdinReader reads the standard input of the process until
+// a context is done. A single goroutine reads os.Stdin for all
+// readers, so a cancelled command neither leaves a goroutine
+// blocked on os.Stdin nor loses input read on its behalf.
+type stdinReader struct {
+	ctx context.Context
+	buf []byte
+}
+
+func (r *stdinReader) Read(p []byte) (int, error) {
+	stdin.once.Do(func() {
+		stdin.data = make(chan []byte)
+		go func() {
+			for {
+				buf := make([]byte, 32*1024)
+				n, err := os.Stdin.Read(buf)
+				if n > 0 {
+					stdin.data <- buf[:n]
+				}
+				if err != nil {
+					stdin.err = err
+					close(stdin.data)
+					return
+				}
+			}
+		}()
+	})
+
+	if len(r.buf) == 0 {
+		select {
+		case data, ok := <-stdin.data:
+			if !ok {
+				return 0, stdin.err
+			}
+			r.buf = data
+		case <-r.ctx.Done():
+			return 0, io.EOF
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// container gets the named container of a pod, or
+// the container kubectl would choose if none is named
+func (k *native) container(ctx context.Context, namespace string, pod string, container string) (string, error) {
+	if container != "" {
+		return container, nil
+	}
+
+	p, err := k.clientset.CoreV1().Pods(namespace).Get(ctx, pod, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	} else if container = p.Annotations["kubectl.kubernetes.io/default-container"]; container != "" {
+		return container, nil
+	} else if len(p.Spec.Containers) == 0 {
+		return "", fmt.Errorf("pod %s has no containers", pod)
+	}
+
+	return p.Spec.Containers[0].Name, nil
+}
+
+// stream streams to and from a pod exec or attach request,
+// putting the terminal in raw mode when stdout is a terminal
+func (k *native) stream(ctx context.Context, url *url.URL, stdin io.Reader, stdout io.Writer, stderr io.Writer, tty bool) error {
+	executor, err := remotecommand.NewSPDYExecutor(k.config, "POST", url)
+	if err != nil {
+		return err
+	}
+
+	options := remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: stdout,
+		Tty:    tty,
+	}
+	if !tty {
+		options.Stderr = stderr
+	}
+	fn := func() error {
+		err := executor.StreamWithContext(ctx, options)
+		var exitErr utilexec.ExitError
+		if errors.As(err, &exitErr) && exitErr.Exited() {
+			return &exitError{
+				code: exitErr.ExitStatus(),
+				msg:  fmt.Sprintf("command terminated with exit code %d", exitErr.ExitStatus()),
+			}
+		}
+		return err
+	}
+
+	if !tty || !term.IsTerminal(stdout) {
+		return fn()
+	}
+
+	t := term.TTY{
+		In:  os.Stdin,
+		Out: stdout,
+		Raw: stdin != nil,
+		// Interrupts cancel the context, so only restore the terminal
+		Parent: interrupt.New(func(os.Signal) {}),
+	}
+	if size := t.GetSize(); size != nil {
+		options.TerminalSizeQueue = t.MonitorSize(size)
+	}
+
+	return t.Safe(fn)
+}
+
+func (k *native) exec(ctx context.Context, c *commandLine, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	if len(c.args) != 1 || len(c.exec) == 0 {
+		return errors.New("a pod and a command must be specified")
+	}
+
+	namespace, pod := k.namespaceOf(c), strings.TrimPrefix(c.args[0], "pod/")
+	container, err := k.container(ctx, namespace, pod, c.flags["container"])
+	if err != nil {
+		return err
+	}
+	if !c.bool("stdin", false) {
+		stdin = nil
+	}
+	tty := c.bool("tty", false)
+
+	req := k.clientset.CoreV1().RESTClient().Post().
+		Namespace(namespace).Resource("pods").Name(pod).SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: container,
+			Command:   c.exec,
+			Stdin:     stdin != nil,
+			Stdout:    true,
+			Stderr:    !tty,
+			TTY:       tty,
+		}, scheme.ParameterCodec)
+
+	return k.stream(ctx, req.URL(), stdin, stdout, stderr, tty)
+}
+
+func (k *native) attach(ctx context.Context, c *commandLine, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	if len(c.args) != 1 {
+		return errors.New("a pod must be specified")
+	}
+
+	namespace, pod := k.namespaceOf(c), strings.TrimPrefix(c.args[0], "pod/")
+	container, err := k.container(ctx, namespace, pod, c.flags["container"])
+	if err != nil {
+		return err
+	}
+	if !c.bool("stdin", false) {
+		stdin = nil
+	}
+	tty := c.bool("tty", false)
+
+	return k.stream(ctx, k.attachURL(namespace, pod, &corev1.PodAttachOptions{
+		Container: container,
+		Stdin:     stdin != nil,
+		Stdout:    true,
+		Stderr:    !tty,
+		TTY:       tty,
+	}), stdin, stdout, stderr, tty)
+}
+
+func (k *native) attachURL(namespace string, pod string, options *corev1.PodAttachOptions) *url.URL {
+	return k.clientset.CoreV1().RESTClient().Post().
+		Namespace(namespace).Resource("pods").Name(pod).SubResource("attach").
+		VersionedParams(options, scheme.ParameterCodec).URL()
+}
+
+func (k *native) logs(ctx context.Context, c *commandLine, stdout io.Writer) error {
+	if len(c.args) != 1 {
+		return errors.New("a pod must be specified")
+	}
+
+	namespace, pod := k.namespaceOf(c), strings.TrimPrefix(c.args[0], "pod/")
+	container, err := k.container(ctx, namespace, pod, c.flags["container"])
+	if err != nil {
+		return err
+	}
+
+	stream, err := k.clientset.CoreV1().Pods(namespace).GetLogs(pod, &corev1.PodLogOptions{
+		Container: container,
+		Follow:    c.bool("follow", false),
+	}).Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	_, err = io.Copy(stdout, stream)
+	return err
+}
+
+// forwardTarget resolves the pod that a port forward connects to,
+// translating the ports of a service to the ports of one of its pods
+func (k *native) forwardTarget(ctx context.Context, namespace string, target string, ports []string) (string, []string, error) {
+	typeName := strings.SplitN(target, "/", 2)
+	if len(typeName) == 1 {
+		return target, ports, nil
+	}
+	switch typeName[0] {
+	case "po", "pod", "pods":
+		return typeName[1], ports, nil
+	case "svc", "service", "services":
+	default:
+		return "", nil, fmt.Errorf(`cannot forward ports of "%s"`, target)
+	}
+
+	svc, err := k.clientset.CoreV1().Services(namespace).Get(ctx, typeName[1], metav1.GetOptions{})
+	if err != nil {
+		return "", nil, err
+	}
+	pods, err := k.clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(svc.Spec.Selector).String(),
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	var pod *corev1.Pod
+	for i := range pods.Items {
+		if pods.Items[i].Status.Phase == corev1.PodRunning && pods.Items[i].DeletionTimestamp == nil {
+			pod = &pods.Items[i]
+			break
+		}
+	}
+	if pod == nil {
+		return "", nil, fmt.Errorf("service %s has no running pods", svc.Name)
+	}
+
+	podPorts := make([]string, len(ports))
+	for i, port := range ports {
+		localRemote := strings.SplitN(port, ":", 2)
+		remote, err := strconv.Atoi(localRemote[len(localRemote)-1])
+		if err != nil {
+			return "", nil, fmt.Errorf(`invalid port "%s"`, port)
+		}
+		for _, sp := range svc.Spec.Ports {
+			if int(sp.Port) != remote {
+				continue
+			} else if sp.TargetPort.Type == intstr.Int && sp.TargetPort.IntVal != 0 {
+				remote = int(sp.TargetPort.IntVal)
+			} else if sp.TargetPort.Type == intstr.String {
+				for _, c := range pod.Spec.Containers {
+					for _, cp := range c.Ports {
+						if cp.Name == sp.TargetPort.StrVal {
+							remote = int(cp.ContainerPort)
+						}
+					}
+				}
+			}
+		}
+		localRemote[len(localRemote)-1] = strconv.Itoa(remote)
+		podPorts[i] = strings.Join(localRemote, ":")
+	}
+
+	return pod.Name, podPorts, nil
+}
+
+func (k *native) portForward(ctx context.Context, c *commandLine, stdout io.Writer, stderr io.Writer) error {
+	if len(c.args) < 2 {
+		return errors.New("a pod or service and ports must be specified")
+	}
+
+	namespace := k.namespaceOf(c)
+	pod, ports, err := k.forwardTarget(ctx, namespace, c.args[0], c.args[1:])
+	if err != nil {
+		return err
+	}
+
+	transport, upgrader, err := spdy.RoundTripperFor(k.config)
+	if err != nil {
+		return err
+	}
+	req := k.clientset.CoreV1().RESTClient().Post().
+		Namespace(namespace).Resource("pods").Name(pod).SubResource("portforward")
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, "POST", req.URL())
+
+	stop := make(chan struct{})
+	forwarder, err := portforward.New(dialer, ports, stop, nil, stdout, stderr)
+	if err != nil {
+		return err
+	}
+
+	// Forwarding continues until the context is cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(stop)
+		case <-done:
+		}
+	}()
+
+	return forwarder.ForwardPorts()
+}
+
+// awaitPod waits until a condition holds for a pod
+func (k *native) awaitPod(ctx context.Context, namespace string, name string, condition func(pod *corev1.Pod) bool) (*corev1.Pod, error) {
+	pods := k.clientset.CoreV1().Pods(namespace)
+	for {
+		pod, err := pods.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		} else if condition(pod) {
+			return pod, nil
+		}
+
+		w, err := pods.Watch(ctx, metav1.ListOptions{
+			FieldSelector:   fields.OneTermEqualSelector("metadata.name", name).String(),
+			ResourceVersion: pod.ResourceVersion,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for event := range w.ResultChan() {
+			if event.Type == watch.Deleted {
+				w.Stop()
+				return nil, apierrors.NewNotFound(corev1.Resource("pods"), name)
+			} else if pod, ok := event.Object.(*corev1.Pod); ok && condition(pod) {
+				w.Stop()
+				return pod, nil
+			} else if event.Type == watch.Error {
+				break
+			}
+		}
+		w.Stop()
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		// The watch ended early, so check again
+	}
+}
+
+func terminated(pod *corev1.Pod) bool {
+	return pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+}
+
+func (k *native) runPod(ctx context.Context, c *commandLine, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	if len(c.args) != 1 || c.flags["image"] == "" {
+		return errors.New("a pod name and image must be specified")
+	}
+
+	name := c.args[0]
+	attach := c.bool("stdin", false)
+	restart := corev1.RestartPolicy(c.flags["restart"])
+	if restart == "" {
+		restart = corev1.RestartPolicyAlways
+	}
+	pod := &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Pod",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				"run": name,
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:      name,
+				Image:     c.flags["image"],
+				Stdin:     attach,
+				StdinOnce: attach,
+			}},
+			RestartPolicy: restart,
+		},
+	}
+
+	// Overrides are merged the same way kubectl merges them
+	if overrides := c.flags["overrides"]; overrides != "" {
+		original, err := json.Marshal(pod)
+		if err != nil {
+			return err
+		}
+		merged, err := strategicpatch.StrategicMergePatch(original, []byte(overrides), pod)
+		if err != nil {
+			return err
+		}
+		pod = &corev1.Pod{}
+		if err = json.Unmarshal(merged, pod); err != nil {
+			return err
+		}
+	}
+
+	namespace := k.namespaceOf(c)
+	pods := k.clientset.CoreV1().Pods(namespace)
+	pod, err := pods.Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+	if c.bool("rm", false) {
+		defer pods.Delete(context.Background(), name, metav1.DeleteOptions{})
+	}
+	if !c.bool("quiet", false) {
+		fmt.Fprintf(stderr, "pod/%s created\n", name)
+	}
+	if !attach {
+		return nil
+	}
+
+	if pod, err = k.awaitPod(ctx, namespace, name, func(pod *corev1.Pod) bool {
+		return pod.Status.Phase != corev1.PodPending
+	}); err != nil {
+		return err
+	} else if pod.Status.Phase == corev1.PodRunning {
+		if err = k.stream(ctx, k.attachURL(namespace, name, &corev1.PodAttachOptions{
+			Container: pod.Spec.Containers[0].Name,
+			Stdin:     true,
+			Stdout:    true,
+			Stderr:    true,
+		}), stdin, stdout, stderr, false); err != nil {
+			return err
+		}
+	}
+
+	if pod, err = k.awaitPod(ctx, namespace, name, terminated); err != nil {
+		return err
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if state := status.State.Terminated; state != nil && state.ExitCode != 0 {
+			return &exitError{
+				code: int(state.ExitCode),
+				msg:  fmt.Sprintf("pod %s/%s terminated (%s)", namespace, name, state.Reason),
+			}
+		}
+	}
+	if pod.Status.Phase == corev1.PodFailed {
+		return fmt.Errorf("pod %s/%s failed", namespace, name)
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/stepro/kdo/pkg/kubectl"
+	"github.com/stepro/kdo/pkg/output"
+)
+
+func pkgerror(err error) error {
+	if err != nil {
+		err = fmt.Errorf("listener: %v", err)
+	}
+	return err
+}
+
+// ContainerName is the name of the container that listens
+// on container ports and proxies connections back to kdo
+const ContainerName = "kdo-listen"
+
+const dir = "/tmp/kdo-listen"
+
+// Each accepted connection is represented by a pair of named pipes
+// and is announced by appending a line to the requests file, which
+// kdo follows in order to connect the pipes to a local port
+const connectScript = `id=$$
+mkfifo ` + dir + `/$id.in ` + dir + `/$id.out
+echo "$id $1" >> ` + dir + `/requests
+cat ` + dir + `/$id.in &
+cat > ` + dir + `/$id.out
+wait
+rm -f ` + dir + `/$id.in ` + dir + `/$id.out
+`
+
+const followScript = `until [ -e ` + dir + `/requests ]; do sleep 1; done
+echo ready
+exec tail -n +1 -f ` + dir + `/requests
+`
+
+const pipeScript = `cat ` + dir + `/$1.out &
+cat > ` + dir + `/$1.in
+wait
+`
+
+// Port represents a container port forwarded to a local port
+type Port struct {
+	Remote string
+	Local  string
+}
+
+// Parse parses a set of port specifications in the form remote[:local]
+func Parse(specs []string) ([]Port, error) {
+	var ports []Port
+
+	for _, spec := range specs {
+		remoteLocal := strings.SplitN(spec, ":", 2)
+		if len(remoteLocal) == 1 {
+			remoteLocal = append(remoteLocal, remoteLocal[0])
+		}
+		for _, port := range remoteLocal {
+			if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+				return nil, fmt.Errorf(`invalid listen port "%s"`, spec)
+			}
+		}
+		ports = append(ports, Port{
+			Remote: remoteLocal[0],
+			Local:  remoteLocal[1],
+		})
+	}
+
+	return ports, nil
+}
+
+// Container gets the specification of a container that
+// listens on a set of localhost ports in the pod network
+// and runs an image that provides socat and a shell
+func Container(ports []Port, image string) map[string]interface{} {
+	script := "mkdir -p " + dir + "\n"
+	script += ": > " + dir + "/requests\n"
+	script += "cat > " + dir + "/connect.sh <<'EOF'\n" + connectScript + "EOF\n"
+	for _, port := range ports {
+		script += fmt.Sprintf(`socat TCP4-LISTEN:%s,bind=127.0.0.1,fork,reuseaddr EXEC:"sh %s/connect.sh %s" &`+"\n", port.Remote, dir, port.Remote)
+	}
+	script += "wait\n"
+
+	return map[string]interface{}{
+		"name":    ContainerName,
+		"image":   image,
+		"command": []string{"/bin/sh", "-c", script},
+	}
+}
+
+// Start starts forwarding connections made to container ports
+// in a pod back to local ports, returning a function that stops,
+// and reports a warning if forwarding ends before it is stopped
+func Start(k kubectl.CLI, pod string, ports []Port, out *output.Interface) (func(), error) {
+	locals := map[string]string{}
+	for _, port := range ports {
+		locals[port.Remote] = port.Local
+	}
+
+	active := make(chan bool)
+	ended := make(chan error, 1)
+	ready := false
+	stop := k.StartLines([]string{"exec", pod, "--container", ContainerName, "--", "/bin/sh", "-c", followScript}, func(line string) {
+		if !ready {
+			ready = line == "ready"
+			if ready {
+				active <- true
+			}
+			return
+		}
+		idPort := strings.Split(line, " ")
+		if len(idPort) != 2 || locals[idPort[1]] == "" {
+			return
+		}
+		go connect(k, pod, idPort[0], locals[idPort[1]], out)
+	}, ended)
+
+	select {
+	case err := <-ended:
+		return nil, pkgerror(err)
+	case <-active:
+	}
+
+	stopped := make(chan bool)
+	go func() {
+		select {
+		case err := <-ended:
+			select {
+			case <-stopped:
+				// Stopping ends the stream
+				return
+			default:
+			}
+			if err == nil {
+				err = errors.New("stream ended")
+			}
+			out.Warning("stopped forwarding container ports to local ports: %v", err)
+		case <-stopped:
+		}
+	}()
+
+	return func() {
+		close(stopped)
+		stop()
+	}, nil
+}
+
+func connect(k kubectl.CLI, pod string, id string, port string, out *output.Interface) {
+	args := []string{"exec", pod, "--container", ContainerName, "-i", "--", "/bin/sh", "-c", pipeScript, "sh", id}
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		out.Warning("unable to connect to local port %s: %v", port, err)
+		// Release the container side of the connection
+		k.Pipe(strings.NewReader(""), ioutil.Discard, args...)
+		return
+	}
+	defer conn.Close()
+
+	out.Debug("forwarding connection %s to local port %s", id, port)
+	if err = k.Pipe(conn, conn, args...); err != nil {
+		out.Debug("failed to forward connection %s: %v", id, err)
+	}
+}
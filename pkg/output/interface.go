@@ -113,6 +113,9 @@ type Operation interface {
 	Aborted()
 	Failed()
 	Done()
+	// DoneWith reports that the operation completed
+	// with a status that describes its result
+	DoneWith(format string, v ...interface{})
 }
 
 type operation struct {
@@ -205,6 +208,19 @@ func (o *operation) Done() {
 	o.end()
 }
 
+func (o *operation) DoneWith(format string, v ...interface{}) {
+	o.in.mu.Lock()
+	defer o.in.mu.Unlock()
+
+	if o.op == nil {
+		return
+	}
+
+	o.op.DoneWith(format, v...)
+
+	o.end()
+}
+
 // Do performs an operation
 func (in *Interface) Do(format string, v ...interface{}) error {
 	op := in.Start(format, v[:len(v)-1]...)
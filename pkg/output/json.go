@@ -101,6 +101,10 @@ func (o *jsonOperation) Done() {
 	o.h.write("done", "", o.id, nil)
 }
 
+func (o *jsonOperation) DoneWith(format string, v ...interface{}) {
+	o.h.write("done", "", o.id, fmt.Sprintf(format, v...))
+}
+
 func (h *jsonHandler) NewWriter(label string, level Level, err bool) io.WriteCloser {
 	var typeName string
 	switch level {
@@ -234,6 +234,10 @@ func (o *stdOperation) Done() {
 	o.writeStatus(ansiColorGreen, "done")
 }
 
+func (o *stdOperation) DoneWith(format string, v ...interface{}) {
+	o.writeStatus(ansiColorGreen, fmt.Sprintf(format, v...))
+}
+
 func (h *stdHandler) NewWriter(label string, level Level, err bool) io.WriteCloser {
 	var prefix string
 	if label != "" {
@@ -2,12 +2,15 @@ package pod
 
 import (
 	"bytes"
+	"fmt"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/ghodss/yaml"
+	"github.com/stepro/kdo/pkg/filesync"
 	"github.com/stepro/kdo/pkg/kubectl"
+	"github.com/stepro/kdo/pkg/listener"
 	"github.com/stepro/kdo/pkg/output"
 	"github.com/stepro/kdo/pkg/replacer"
 )
@@ -22,18 +25,40 @@ type Config struct {
 	Annotations        map[string]*string
 	Spec               map[string]interface{}
 	ContainerSpec      map[string]interface{}
+	StrategicMerge     bool
 	Container          string
 	Image              string
 	Env                map[string]*string
 	NoLifecycle        bool
 	NoProbes           bool
 	Replace            bool
+	Steering           *replacer.Steering
 	Stdin              bool
 	TTY                bool
 	Command            []string
+	Listen             []listener.Port
+	ListenImage        string
+	Restartable        bool
+	SyncAgent          bool
+	KeepImages         int
+	ImagePullPolicy    string
+	ContainerImages    map[string]string
+	BuiltImages        []string
+	AwaitImage         string
+	NodeName           string
 	Detach             bool
 }
 
+// built indicates if an image was built by kdo
+func (c *Config) built(image string) bool {
+	for _, built := range c.BuiltImages {
+		if built == image {
+			return true
+		}
+	}
+	return false
+}
+
 // Apply creates or replaces a pod associated with a hash
 func Apply(k kubectl.CLI, hash string, config *Config, build func(pod string) error, out *output.Interface) (*Process, error) {
 	var p *Process
@@ -61,8 +86,15 @@ func Apply(k kubectl.CLI, hash string, config *Config, build func(pod string) er
 			return err
 		}
 
+		labels := map[string]string{}
+		for k, v := range manifest.obj("metadata").obj("labels") {
+			if v, ok := v.(string); ok {
+				labels[k] = v
+			}
+		}
+
 		var selector string
-		if config.InheritKind == "service" && config.Replace {
+		if config.InheritKind == "service" && config.Replace && config.Steering == nil {
 			op.Progress("determining pod selector")
 			nameValues, err := k.Lines("get", "service", config.InheritName, "-o", "go-template={{range $k, $v := .spec.selector}}{{$k}}={{$v}}\n{{end}}")
 			if err != nil {
@@ -81,6 +113,19 @@ func Apply(k kubectl.CLI, hash string, config *Config, build func(pod string) er
 			}
 		}
 
+		for name := range config.ContainerImages {
+			found := false
+			for _, c := range manifest.obj("spec").arr("containers") {
+				if c.(map[string]interface{})["name"] == name {
+					found = true
+					break
+				}
+			}
+			if !found || name == container {
+				return fmt.Errorf(`container "%s" cannot be built separately`, name)
+			}
+		}
+
 		op.Progress("generating manifest")
 		manifest.with("metadata", func(metadata object) {
 			metadata["name"] = name
@@ -122,7 +167,11 @@ func Apply(k kubectl.CLI, hash string, config *Config, build func(pod string) er
 			})
 		}).with("spec", func(spec object) {
 			if config.Spec != nil {
-				spec.apply(config.Spec)
+				if config.StrategicMerge {
+					spec.merge(config.Spec)
+				} else {
+					spec.apply(config.Spec)
+				}
 			}
 			if build != nil {
 				spec.appendobj("volumes", map[string]interface{}{
@@ -138,7 +187,7 @@ func Apply(k kubectl.CLI, hash string, config *Config, build func(pod string) er
 					},
 				}).appendobj("initContainers", map[string]interface{}{
 					"name":  "kdo-await-image-build",
-					"image": "docker",
+					"image": config.AwaitImage,
 					"volumeMounts": []map[string]interface{}{
 						{
 							"name":      "kdo-host-run-containerd",
@@ -149,30 +198,25 @@ func Apply(k kubectl.CLI, hash string, config *Config, build func(pod string) er
 							"mountPath": "/run/docker.sock",
 						},
 					},
-					"command": []string{
-						"/bin/sh",
-						"-c",
-						`if [ -S /run/containerd/containerd.sock ]; then
-                          apk add curl
-                          curl -L https://github.com/kubernetes-sigs/cri-tools/releases/download/v1.22.0/crictl-v1.22.0-linux-amd64.tar.gz | tar -xzvf -
-                          while [ -z "$(/crictl --runtime-endpoint unix:///run/containerd/containerd.sock images | grep '` + strings.Replace(config.Image, ":", "\\s*", 1) + `')" ]; do
-						  	sleep 1
-						  done
-                        elif [ -S /var/run/docker.sock ]; then
-                          while [ -z "$(docker images ` + config.Image + ` --format '{{.Repository}}')" ]; do
-						  	sleep 1
-						  done
-                        fi`,
-					},
+					// Remove all but the most recent images built for the hash
+					"args": append([]string{"--keep", strconv.Itoa(config.KeepImages)}, config.BuiltImages...),
 				})
 			}
+			if config.SyncAgent {
+				spec.appendobj("volumes", filesync.AgentVolume()).
+					appendobj("initContainers", filesync.AgentInitContainer())
+			}
 			spec.withelem("containers", container, func(container object) {
 				if config.ContainerSpec != nil {
-					container.apply(config.ContainerSpec)
+					if config.StrategicMerge {
+						container.merge(config.ContainerSpec)
+					} else {
+						container.apply(config.ContainerSpec)
+					}
 				}
 				container["image"] = config.Image
-				if build != nil {
-					container["imagePullPolicy"] = "Never"
+				if config.ImagePullPolicy != "" && config.built(config.Image) {
+					container["imagePullPolicy"] = config.ImagePullPolicy
 				}
 				for k, v := range config.Env {
 					container.withelem("env", k, func(e object) {
@@ -197,12 +241,57 @@ func Apply(k kubectl.CLI, hash string, config *Config, build func(pod string) er
 					container["command"] = config.Command
 					delete(container, "args")
 				}
+				if config.SyncAgent {
+					container.appendobj("volumeMounts", filesync.AgentVolumeMount())
+				}
+				if config.Restartable && err == nil {
+					err = restartable(container, config.SyncAgent)
+				}
 			})
+			for name, image := range config.ContainerImages {
+				spec.withelem("containers", name, func(container object) {
+					container["image"] = image
+					if config.ImagePullPolicy != "" && config.built(image) {
+						container["imagePullPolicy"] = config.ImagePullPolicy
+					}
+				})
+			}
+			if len(config.Listen) > 0 {
+				spec.appendobj("containers", listener.Container(config.Listen, config.ListenImage))
+			}
+			if config.NodeName != "" {
+				// Unlike spec.nodeName, required node affinity
+				// lets the scheduler check that the pod fits
+				hostname := object{
+					"key":      "kubernetes.io/hostname",
+					"operator": "In",
+					"values":   []interface{}{config.NodeName},
+				}
+				spec.with("affinity", func(affinity object) {
+					affinity.with("nodeAffinity", func(nodeAffinity object) {
+						nodeAffinity.with("requiredDuringSchedulingIgnoredDuringExecution", func(required object) {
+							terms := required.arr("nodeSelectorTerms")
+							if len(terms) == 0 {
+								terms = array{map[string]interface{}{}}
+							}
+							// Terms are alternatives, so each must require the node
+							for _, term := range terms {
+								object(term.(map[string]interface{})).appendobj("matchExpressions", hostname)
+							}
+							required["nodeSelectorTerms"] = []interface{}(terms)
+						})
+					})
+				})
+			}
 			if !config.Detach {
 				spec["restartPolicy"] = "Never"
 			}
 		})
 
+		if err != nil {
+			return err
+		}
+
 		op.Progress("applying manifest")
 		data, err := yaml.Marshal(manifest)
 		if err != nil {
@@ -216,7 +305,7 @@ func Apply(k kubectl.CLI, hash string, config *Config, build func(pod string) er
 			}
 		}()
 
-		if config.Replace {
+		if config.Replace && config.Steering == nil {
 			if err = replacer.Apply(k, config.InheritKind, config.InheritName, replicas, selector, hash, out); err != nil {
 				return err
 			}
@@ -235,7 +324,8 @@ func Apply(k kubectl.CLI, hash string, config *Config, build func(pod string) er
 		}
 
 		for {
-			ready, err := k.String("get", "pod", name, "--output", `go-template={{range .status.conditions}}{{if eq .type "Ready"}}{{.status}}{{end}}{{end}} {{range .status.containerStatuses}}{{if eq .name "`+container+`"}}{{if .state.terminated}}{{.state.terminated.exitCode}}{{end}}{{end}}{{end}}`)
+			var ready string
+			ready, err = k.String("get", "pod", name, "--output", `go-template={{range .status.conditions}}{{if eq .type "Ready"}}{{.status}}{{end}}{{end}} {{range .status.containerStatuses}}{{if eq .name "`+container+`"}}{{if .state.terminated}}{{.state.terminated.exitCode}}{{end}} {{if .state.waiting}}{{.state.waiting.reason}}{{end}}{{end}}{{end}}`)
 			if err != nil {
 				return err
 			}
@@ -243,9 +333,14 @@ func Apply(k kubectl.CLI, hash string, config *Config, build func(pod string) er
 				break
 			} else {
 				tokens := strings.Split(ready, " ")
-				if tokens[1] != "" {
-					exitCode, err := strconv.Atoi(tokens[1])
-					if err != nil {
+				if len(tokens) > 2 && tokens[2] == "ErrImageNeverPull" {
+					// Assigned so that the pod is deleted
+					err = ErrImageNotPresent
+					return err
+				}
+				if len(tokens) > 1 && tokens[1] != "" {
+					var exitCode int
+					if exitCode, err = strconv.Atoi(tokens[1]); err != nil {
 						return err
 					}
 					p.exitCode = &exitCode
@@ -255,6 +350,13 @@ func Apply(k kubectl.CLI, hash string, config *Config, build func(pod string) er
 			time.Sleep(1 * time.Second)
 		}
 
+		// Traffic is only steered to a pod that is ready
+		if config.Replace && config.Steering != nil && p.exitCode == nil {
+			if err = replacer.Steer(k, config.Steering, config.InheritKind, config.InheritName, labels, hash, out); err != nil {
+				return err
+			}
+		}
+
 		return nil
 	})
 	if err != nil {
@@ -1,5 +1,9 @@
 package pod
 
+import (
+	"fmt"
+)
+
 type object map[string]interface{}
 
 func (o object) num(k string) int {
@@ -32,6 +36,21 @@ func (o object) with(k string, fn func(o object)) object {
 	return o
 }
 
+func (o object) strs(k string) []string {
+	switch v := o[k].(type) {
+	case []string:
+		return v
+	case []interface{}:
+		var s []string
+		for _, elem := range v {
+			s = append(s, fmt.Sprintf("%v", elem))
+		}
+		return s
+	}
+
+	return nil
+}
+
 type array []interface{}
 
 func (o object) arr(k string) array {
@@ -79,15 +98,103 @@ func (o object) withelem(k string, name string, fn func(o object)) object {
 	return o
 }
 
-func (o object) apply(src object) object {
-	// TODO: actual JSON merge patch
-	for k, v := range src {
-		o[k] = v
+// apply applies a JSON merge patch (RFC 7386)
+func (o object) apply(patch object) object {
+	for k, v := range patch {
+		if v == nil {
+			delete(o, k)
+		} else if p, ok := v.(map[string]interface{}); ok {
+			t, ok := o[k].(map[string]interface{})
+			if !ok {
+				t = map[string]interface{}{}
+			}
+			o[k] = map[string]interface{}(object(t).apply(p))
+		} else {
+			o[k] = v
+		}
 	}
 
 	return o
 }
 
+// mergeKeys maps list properties to the keys used
+// to identify their elements in a strategic merge
+var mergeKeys = map[string]string{
+	"containers":          "name",
+	"env":                 "name",
+	"ephemeralContainers": "name",
+	"hostAliases":         "ip",
+	"imagePullSecrets":    "name",
+	"initContainers":      "name",
+	"ports":               "containerPort",
+	"volumeDevices":       "devicePath",
+	"volumeMounts":        "mountPath",
+	"volumes":             "name",
+}
+
+// merge applies a strategic merge patch, which is a JSON merge
+// patch that also merges lists of objects with a known merge key
+// and supports "$patch" directives to delete or replace elements
+func (o object) merge(patch object) object {
+	if patch["$patch"] == "replace" {
+		for k := range o {
+			delete(o, k)
+		}
+	}
+
+	for k, v := range patch {
+		if k == "$patch" {
+			continue
+		} else if v == nil {
+			delete(o, k)
+		} else if p, ok := v.(map[string]interface{}); ok {
+			t, ok := o[k].(map[string]interface{})
+			if !ok {
+				t = map[string]interface{}{}
+			}
+			if p["$patch"] == "delete" {
+				delete(o, k)
+			} else {
+				o[k] = map[string]interface{}(object(t).merge(p))
+			}
+		} else if p, ok := v.([]interface{}); ok && mergeKeys[k] != "" {
+			t, _ := o[k].([]interface{})
+			o[k] = []interface{}(array(t).merge(mergeKeys[k], p))
+		} else {
+			o[k] = v
+		}
+	}
+
+	return o
+}
+
+func (a array) merge(key string, patch []interface{}) array {
+	for _, v := range patch {
+		p, ok := v.(map[string]interface{})
+		if !ok || p[key] == nil {
+			a = append(a, v)
+			continue
+		}
+		i := 0
+		for ; i < len(a); i++ {
+			if t, ok := a[i].(map[string]interface{}); ok && t[key] == p[key] {
+				break
+			}
+		}
+		if p["$patch"] == "delete" {
+			if i < len(a) {
+				a = append(a[:i], a[i+1:]...)
+			}
+		} else if i < len(a) {
+			a[i] = map[string]interface{}(object(a[i].(map[string]interface{})).merge(p))
+		} else {
+			a = append(a, map[string]interface{}(object(map[string]interface{}{}).merge(p)))
+		}
+	}
+
+	return a
+}
+
 func (o object) set(src object, k ...string) object {
 	for _, k := range k {
 		v := src[k]
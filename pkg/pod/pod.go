@@ -1,12 +1,13 @@
 package pod
 
 import (
+	"errors"
 	"fmt"
 )
 
 func pkgerror(err error) error {
 	if err != nil {
-		err = fmt.Errorf("pod: %v", err)
+		err = fmt.Errorf("pod: %w", err)
 	}
 	return err
 }
@@ -15,3 +16,13 @@ func pkgerror(err error) error {
 func Name(hash string) string {
 	return "kdo-" + hash
 }
+
+// ErrImageNotPresent is reported when a pod cannot start
+// because its local image is not present on the node
+var ErrImageNotPresent = errors.New("image is not present on the node")
+
+// IsImageNotPresent indicates if an error was caused
+// by a local image not being present on the node
+func IsImageNotPresent(err error) bool {
+	return errors.Is(err, ErrImageNotPresent)
+}
@@ -20,6 +20,11 @@ func (p *Process) Exited() bool {
 	return p.exitCode != nil
 }
 
+// Node gets the name of the node that is running the process
+func (p *Process) Node() (string, error) {
+	return p.k.String("get", "pod", p.Pod, "--output", "go-template={{.spec.nodeName}}")
+}
+
 // ExitCode waits for the process to complete and gets its exit code
 func (p *Process) ExitCode() (int, error) {
 	if p.exitCode == nil {
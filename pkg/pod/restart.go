@@ -0,0 +1,58 @@
+package pod
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/stepro/kdo/pkg/filesync"
+)
+
+// supervisorScript runs a command and runs it again whenever it
+// exits after a restart has been requested using RestartCommand
+const supervisorScript = `trap 'kill $pid 2>/dev/null' TERM INT
+while :; do
+  "$@" <&0 &
+  pid=$!
+  echo $pid > $STATE/kdo-pid
+  wait $pid
+  code=$?
+  if [ -e $STATE/kdo-restart ]; then
+    rm -f $STATE/kdo-restart
+    continue
+  fi
+  exit $code
+done
+`
+
+const restartScript = `[ -e $STATE/kdo-pid ] && touch $STATE/kdo-restart && kill $(cat $STATE/kdo-pid)`
+
+// stateScript sets the directory in which the supervisor
+// keeps its state, which is the sync agent directory when
+// the agent is injected, as the container may have no /tmp
+func stateScript(agent bool, script string) string {
+	dir := "/tmp"
+	if agent {
+		dir = filesync.AgentPath
+	}
+	return strings.ReplaceAll(script, "$STATE", dir)
+}
+
+// RestartCommand gets a command that restarts the main
+// process in a container of a pod with a restartable config
+func RestartCommand(agent bool) []string {
+	return filesync.ShellCommand(agent, stateScript(agent, restartScript))
+}
+
+// restartable wraps the command of a container in a supervisor
+func restartable(container object, agent bool) error {
+	command := container.strs("command")
+	if len(command) == 0 {
+		return errors.New("cannot restart a container whose command comes from its image; specify the command explicitly")
+	}
+	command = append(command, container.strs("args")...)
+
+	container["command"] = filesync.ShellCommand(agent, stateScript(agent, supervisorScript), command...)
+	delete(container, "args")
+
+	return nil
+}
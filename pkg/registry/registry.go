@@ -0,0 +1,165 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/stepro/kdo/pkg/kubectl"
+	"github.com/stepro/kdo/pkg/output"
+	"github.com/stepro/kdo/pkg/portforward"
+)
+
+func pkgerror(err error) error {
+	if err != nil {
+		err = fmt.Errorf("registry: %v", err)
+	}
+	return err
+}
+
+// Managed is the registry name that refers to the kdo-managed registry
+const Managed = "kdo"
+
+const manifest = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: kdo-registry
+  labels:
+    component: kdo-registry
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      component: kdo-registry
+  template:
+    metadata:
+      labels:
+        component: kdo-registry
+    spec:
+      nodeSelector:
+        kubernetes.io/os: linux
+      volumes:
+      - name: data
+        emptyDir: {}
+      containers:
+      - name: kdo-registry
+        image: registry:2
+        env:
+        - name: REGISTRY_STORAGE_DELETE_ENABLED
+          value: "true"
+        volumeMounts:
+        - name: data
+          mountPath: /var/lib/registry
+        readinessProbe:
+          tcpSocket:
+            port: 5000
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: kdo-registry
+  labels:
+    component: kdo-registry
+spec:
+  type: NodePort
+  selector:
+    component: kdo-registry
+  ports:
+  - port: 5000
+    targetPort: 5000
+`
+
+// Install installs the managed registry into a namespace
+func Install(k kubectl.CLI, namespace string, out *output.Interface) error {
+	return pkgerror(out.Do("Installing registry", func(op output.Operation) error {
+		op.Progress("applying manifest")
+		if err := k.Input(strings.NewReader(manifest), "--namespace", namespace, "apply", "--filename", "-"); err != nil {
+			return err
+		}
+
+		op.Progress("checking readiness")
+		for {
+			ready, err := k.String("--namespace", namespace, "get", "deployment", "kdo-registry",
+				"--output", "go-template={{.status.readyReplicas}}")
+			if err != nil {
+				return err
+			}
+			if ready != "" && ready != "0" && ready != "<no value>" {
+				break
+			}
+			time.Sleep(1 * time.Second)
+		}
+
+		return nil
+	}))
+}
+
+// ClusterHost gets the host through which pods in the
+// cluster access the managed registry in a namespace
+func ClusterHost(namespace string) string {
+	return "kdo-registry." + namespace + ":5000"
+}
+
+// NodePort gets the node port of the managed registry
+// in a namespace, or empty if it is not installed
+func NodePort(k kubectl.CLI, namespace string) (string, error) {
+	nodePort, err := k.String("--namespace", namespace, "get", "service", "kdo-registry",
+		"--ignore-not-found", "--output", "go-template={{range .spec.ports}}{{.nodePort}}{{end}}")
+	return nodePort, pkgerror(err)
+}
+
+// PullHost first ensures the managed registry is installed and
+// then gets the host from which nodes pull images, which is the
+// node port on the loopback interface, as container runtimes do
+// not require it to be accessed over TLS; this relies on the
+// node routing loopback traffic to node ports, which kube-proxy
+// enables in iptables mode by setting net.ipv4.conf.all.route_localnet
+func PullHost(k kubectl.CLI, namespace string, out *output.Interface) (string, error) {
+	nodePort, err := NodePort(k, namespace)
+	if err != nil {
+		return "", err
+	}
+
+	if nodePort == "" {
+		if err = Install(k, namespace, out); err != nil {
+			return "", err
+		}
+		return PullHost(k, namespace, out)
+	}
+
+	return "localhost:" + nodePort, nil
+}
+
+// Connect first ensures the managed registry is installed and then
+// connects to it, returning the host to which images are pushed, the
+// host from which nodes pull images and a function that disconnects
+func Connect(k kubectl.CLI, namespace string, out *output.Interface) (string, string, func(), error) {
+	pullHost, err := PullHost(k, namespace, out)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	var pushHost string
+	var stop func()
+	if err = out.Do("Connecting to registry", func() error {
+		localPort, s, err := portforward.StartOne(k, namespace, "service/kdo-registry", "5000")
+		if err != nil {
+			return err
+		}
+		pushHost = "localhost:" + localPort
+		stop = s
+		return nil
+	}); err != nil {
+		return "", "", nil, pkgerror(err)
+	}
+
+	return pushHost, pullHost, stop, nil
+}
+
+// Uninstall uninstalls the managed registry from a namespace
+func Uninstall(k kubectl.CLI, namespace string, out *output.Interface) error {
+	return pkgerror(out.Do("Uninstalling registry", func() error {
+		return k.Run("--namespace", namespace, "delete", "deployment,service", "--selector", "component=kdo-registry", "--ignore-not-found")
+	}))
+}
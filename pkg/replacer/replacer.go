@@ -2,9 +2,11 @@ package replacer
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 
+	"github.com/ghodss/yaml"
 	"github.com/stepro/kdo/pkg/kubectl"
 	"github.com/stepro/kdo/pkg/output"
 )
@@ -129,6 +131,31 @@ fi
 $kubectl delete job kdo-replacer-$HASH --wait=false
 `
 
+// RoleRule represents a rule of the role that replacers run with
+type RoleRule struct {
+	APIGroups []string `json:"apiGroups"`
+	Resources []string `json:"resources"`
+	Verbs     []string `json:"verbs"`
+}
+
+// RoleRules gets the rules of the role that replacers run with,
+// which are also required by a user to create the role
+func RoleRules() ([]RoleRule, error) {
+	for _, doc := range strings.Split(manifest, "\n---\n") {
+		var role struct {
+			Kind  string     `json:"kind"`
+			Rules []RoleRule `json:"rules"`
+		}
+		if err := yaml.Unmarshal([]byte(doc), &role); err != nil {
+			return nil, pkgerror(err)
+		} else if role.Kind == "Role" {
+			return role.Rules, nil
+		}
+	}
+
+	return nil, pkgerror(errors.New("no role in manifest"))
+}
+
 // Apply creates or updates a replacer for a pod
 func Apply(k kubectl.CLI, kind, name string, replicas int, selector string, hash string, out *output.Interface) error {
 	return pkgerror(out.Do("Replacing %s", kind, func(op output.Operation) error {
@@ -163,7 +190,8 @@ func Apply(k kubectl.CLI, kind, name string, replicas int, selector string, hash
 func Wait(k kubectl.CLI, hash string) error {
 	s, err := k.ErrorString("wait", "--for", "delete", "job/kdo-replacer-"+hash)
 	if err != nil {
-		if strings.HasPrefix(s, "Error from server (NotFound)") ||
+		if kubectl.IsNotFound(err) ||
+			strings.HasPrefix(s, "Error from server (NotFound)") ||
 			strings.HasPrefix(s, "error: no matching resources found") {
 			return nil
 		}
@@ -178,7 +206,8 @@ func WaitAll(k kubectl.CLI, out *output.Interface) error {
 	return pkgerror(out.Do("Waiting for all replacers", func() error {
 		s, err := k.ErrorString("wait", "--for", "delete", "job", "--selector", "kdo-job=1", "--all-namespaces")
 		if err != nil {
-			if strings.HasPrefix(s, "error: no matching resources found") {
+			if kubectl.IsNotFound(err) ||
+				strings.HasPrefix(s, "error: no matching resources found") {
 				return nil
 			}
 			return err
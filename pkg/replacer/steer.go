@@ -0,0 +1,324 @@
+package replacer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/stepro/kdo/pkg/kubectl"
+	"github.com/stepro/kdo/pkg/output"
+)
+
+// Steering represents options for steering traffic to a
+// pod while the workload it replaces continues to run
+type Steering struct {
+	// Weight is the percentage of traffic that is steered
+	// to the pod through a service mesh route
+	Weight int
+	// Header is a header in the form name=value that steers
+	// matching requests to the pod through a service mesh route
+	Header string
+}
+
+// mesh indicates if steering requires a service mesh route,
+// as opposed to adding the pod to the endpoints of services
+func (s *Steering) mesh() bool {
+	return s.Weight > 0 || s.Header != ""
+}
+
+type service struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Spec struct {
+		Selector map[string]string `json:"selector"`
+		Ports    []servicePort     `json:"ports"`
+	} `json:"spec"`
+}
+
+type servicePort struct {
+	Name       string      `json:"name,omitempty"`
+	Protocol   string      `json:"protocol,omitempty"`
+	Port       int         `json:"port"`
+	TargetPort interface{} `json:"targetPort,omitempty"`
+}
+
+type pod struct {
+	Metadata struct {
+		Name string `json:"name"`
+		UID  string `json:"uid"`
+	} `json:"metadata"`
+	Spec struct {
+		Containers []struct {
+			Ports []struct {
+				Name          string `json:"name"`
+				ContainerPort int    `json:"containerPort"`
+			} `json:"ports"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		PodIP string `json:"podIP"`
+	} `json:"status"`
+}
+
+// targetPort resolves the port of a pod that a service port targets
+func (p *pod) targetPort(port servicePort) int {
+	switch targetPort := port.TargetPort.(type) {
+	case float64:
+		return int(targetPort)
+	case string:
+		if n, err := strconv.Atoi(targetPort); err == nil {
+			return n
+		}
+		for _, c := range p.Spec.Containers {
+			for _, cp := range c.Ports {
+				if cp.Name == targetPort {
+					return cp.ContainerPort
+				}
+			}
+		}
+	}
+	return port.Port
+}
+
+// services gets the services that select a set of pod labels,
+// or the named service if the replaced resource is a service
+func services(k kubectl.CLI, kind, name string, labels map[string]string) ([]service, error) {
+	var list struct {
+		Items []service `json:"items"`
+	}
+	if kind == "service" {
+		s, err := k.String("get", "service", name, "--output", "json")
+		if err != nil {
+			return nil, err
+		}
+		list.Items = make([]service, 1)
+		return list.Items, json.Unmarshal([]byte(s), &list.Items[0])
+	}
+
+	s, err := k.String("get", "services", "--output", "json")
+	if err != nil {
+		return nil, err
+	} else if err = json.Unmarshal([]byte(s), &list); err != nil {
+		return nil, err
+	}
+
+	var selecting []service
+	for _, svc := range list.Items {
+		if len(svc.Spec.Selector) == 0 {
+			continue
+		}
+		matches := true
+		for k, v := range svc.Spec.Selector {
+			if labels[k] != v {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			selecting = append(selecting, svc)
+		}
+	}
+	if len(selecting) == 0 {
+		return nil, fmt.Errorf("no service selects the pods of %s/%s", kind, name)
+	}
+
+	return selecting, nil
+}
+
+// steeringName gets the name of the resources that steer
+// the traffic of a service to the pod associated with a hash
+func steeringName(hash string, service string) string {
+	name := "kdo-" + hash + "-" + service
+	if len(name) > 63 {
+		name = strings.TrimRight(name[:63], "-")
+	}
+	return name
+}
+
+// Steer steers traffic of the services of a workload, or of a service,
+// to a pod that is ready, through resources owned by the pod so that
+// they are removed, and traffic reverts, when the pod is deleted
+func Steer(k kubectl.CLI, steering *Steering, kind, name string, labels map[string]string, hash string, out *output.Interface) error {
+	return pkgerror(out.Do("Steering traffic", func(op output.Operation) error {
+		op.Progress("determining services")
+		svcs, err := services(k, kind, name, labels)
+		if err != nil {
+			return err
+		}
+
+		var p pod
+		if s, err := k.String("get", "pod", "kdo-"+hash, "--output", "json"); err != nil {
+			return err
+		} else if err = json.Unmarshal([]byte(s), &p); err != nil {
+			return err
+		} else if p.Status.PodIP == "" {
+			return errors.New("pod has no IP address")
+		}
+		metadata := func(name string, service string) map[string]interface{} {
+			labels := map[string]interface{}{
+				"kdo-hash": hash,
+			}
+			if service != "" {
+				labels["kubernetes.io/service-name"] = service
+				labels["endpointslice.kubernetes.io/managed-by"] = "kdo"
+			}
+			return map[string]interface{}{
+				"name":   name,
+				"labels": labels,
+				"ownerReferences": []interface{}{
+					map[string]interface{}{
+						"apiVersion": "v1",
+						"kind":       "Pod",
+						"name":       p.Metadata.Name,
+						"uid":        p.Metadata.UID,
+					},
+				},
+			}
+		}
+
+		if steering.mesh() {
+			op.Progress("checking service mesh routes")
+			nameHosts, err := k.Lines("get", "virtualservices.networking.istio.io",
+				"--output", "go-template={{range .items}}{{$name := .metadata.name}}{{range .spec.hosts}}{{$name}} {{.}}\n{{end}}{{end}}")
+			if err != nil {
+				return fmt.Errorf("steering by weight or header requires Istio: %v", err)
+			}
+			for _, svc := range svcs {
+				for _, nameHost := range nameHosts {
+					nameHost := strings.SplitN(nameHost, " ", 2)
+					if len(nameHost) != 2 || nameHost[0] == steeringName(hash, svc.Metadata.Name) {
+						// A previous pod's virtual service may still be pending deletion
+						continue
+					}
+					if host := nameHost[1]; host == svc.Metadata.Name || strings.HasPrefix(host, svc.Metadata.Name+".") {
+						return fmt.Errorf(`service "%s" is already routed by a virtual service`, svc.Metadata.Name)
+					}
+				}
+			}
+		}
+
+		var items []interface{}
+		for _, svc := range svcs {
+			steeringName := steeringName(hash, svc.Metadata.Name)
+			if !steering.mesh() {
+				addressType := "IPv4"
+				if strings.Contains(p.Status.PodIP, ":") {
+					addressType = "IPv6"
+				}
+				var ports []interface{}
+				for _, port := range svc.Spec.Ports {
+					ports = append(ports, map[string]interface{}{
+						"name":     port.Name,
+						"protocol": port.Protocol,
+						"port":     p.targetPort(port),
+					})
+				}
+				items = append(items, map[string]interface{}{
+					"apiVersion":  "discovery.k8s.io/v1",
+					"kind":        "EndpointSlice",
+					"metadata":    metadata(steeringName, svc.Metadata.Name),
+					"addressType": addressType,
+					"ports":       ports,
+					"endpoints": []interface{}{
+						map[string]interface{}{
+							"addresses": []string{p.Status.PodIP},
+							"conditions": map[string]interface{}{
+								"ready": true,
+							},
+							"targetRef": map[string]interface{}{
+								"kind": "Pod",
+								"name": p.Metadata.Name,
+								"uid":  p.Metadata.UID,
+							},
+						},
+					},
+				})
+				continue
+			}
+
+			// The shadow service selects only the pod
+			var ports []servicePort
+			for _, port := range svc.Spec.Ports {
+				port.TargetPort = p.targetPort(port)
+				ports = append(ports, port)
+			}
+			items = append(items, map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Service",
+				"metadata":   metadata(steeringName, ""),
+				"spec": map[string]interface{}{
+					"selector": map[string]string{
+						"kdo-hash": hash,
+					},
+					"ports": ports,
+				},
+			})
+
+			var routes []interface{}
+			if steering.Header != "" {
+				nameValue := strings.SplitN(steering.Header, "=", 2)
+				routes = append(routes, map[string]interface{}{
+					"match": []interface{}{
+						map[string]interface{}{
+							"headers": map[string]interface{}{
+								strings.ToLower(nameValue[0]): map[string]interface{}{
+									"exact": nameValue[1],
+								},
+							},
+						},
+					},
+					"route": []interface{}{
+						map[string]interface{}{
+							"destination": map[string]interface{}{
+								"host": steeringName,
+							},
+						},
+					},
+				})
+			}
+			route := []interface{}{
+				map[string]interface{}{
+					"destination": map[string]interface{}{
+						"host": svc.Metadata.Name,
+					},
+					"weight": 100 - steering.Weight,
+				},
+			}
+			if steering.Weight > 0 {
+				route = append(route, map[string]interface{}{
+					"destination": map[string]interface{}{
+						"host": steeringName,
+					},
+					"weight": steering.Weight,
+				})
+			}
+			routes = append(routes, map[string]interface{}{
+				"route": route,
+			})
+			items = append(items, map[string]interface{}{
+				"apiVersion": "networking.istio.io/v1beta1",
+				"kind":       "VirtualService",
+				"metadata":   metadata(steeringName, ""),
+				"spec": map[string]interface{}{
+					"hosts": []string{svc.Metadata.Name},
+					"http":  routes,
+				},
+			})
+		}
+
+		data, err := json.Marshal(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "List",
+			"items":      items,
+		})
+		if err != nil {
+			return err
+		}
+
+		op.Progress("applying manifest")
+		return k.Input(strings.NewReader(string(data)), "apply", "--filename", "-")
+	}))
+}
@@ -1,11 +1,18 @@
 package server
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
+	"github.com/ghodss/yaml"
 	"github.com/stepro/kdo/pkg/kubectl"
 	"github.com/stepro/kdo/pkg/output"
 )
@@ -17,17 +24,53 @@ func pkgerror(err error) error {
 	return err
 }
 
-const manifest = `
+// Options represents server component options
+type Options struct {
+	// Image is the image that runs the buildkitd daemon or
+	// forwards connections to the Docker daemon on each node
+	Image string
+	// Namespace is the namespace of the server components
+	Namespace string
+	// NodeSelector restricts the nodes that run server components
+	NodeSelector map[string]string
+	// Tolerations are taints tolerated by server components,
+	// in the form key[=value][:effect], or * to tolerate all
+	Tolerations []string
+	// OnDemand causes server components to run only on the nodes
+	// that run kdo pods, starting when they are first needed,
+	// instead of running on every node as a daemon set
+	OnDemand bool
+	// CacheSize is the size in megabytes beyond which the build
+	// cache of the buildkitd daemon on a node is garbage collected
+	CacheSize int
+	// Version is the version of kdo, with which
+	// server components are stamped when installed
+	Version string
+}
+
+// Annotations with which server components are stamped
+const (
+	versionAnnotation        = "kdo-version"
+	digestAnnotation         = "kdo-manifest-digest"
+	rolledBackFromAnnotation = "kdo-rolled-back-from"
+)
+
+const manifestTemplate = `
 apiVersion: v1
 kind: ConfigMap
 metadata:
-  name: kdo-server
+  name: {{json .Config}}
   labels:
     component: kdo-server
+{{- if .Annotations}}
+  annotations: {{json .Annotations}}
+{{- end}}
 data:
   buildkitd.toml: |-
     [worker.containerd]
       namespace = "k8s.io"
+      gc = true
+      gckeepstorage = {{.CacheSize}}
   entrypoint.sh: |-
     #!/bin/sh
     if [ -e "/run/containerd/containerd.sock" ]; then
@@ -45,6 +88,9 @@ metadata:
   name: kdo-server
   labels:
     component: kdo-server
+{{- if .Annotations}}
+  annotations: {{json .Annotations}}
+{{- end}}
 spec:
   selector:
     matchLabels:
@@ -53,9 +99,14 @@ spec:
     metadata:
       labels:
         component: kdo-server
+{{- if .Annotations}}
+      annotations: {{json .Annotations}}
+{{- end}}
     spec:
-      nodeSelector:
-        kubernetes.io/os: linux
+      nodeSelector: {{json .NodeSelector}}
+{{- if .Tolerations}}
+      tolerations: {{json .Tolerations}}
+{{- end}}
       volumes:
       - name: host-run-containerd
         hostPath:
@@ -83,7 +134,7 @@ spec:
           path: /var/log
       - name: config
         configMap:
-          name: kdo-server
+          name: {{json .Config}}
           items:
           - key: buildkitd.toml
             path: buildkitd.toml
@@ -93,7 +144,7 @@ spec:
             mode: 0777
       containers:
       - name: kdo-server
-        image: moby/buildkit
+        image: {{json .Image}}
         volumeMounts:
         - name: host-run-containerd
           mountPath: /run/containerd
@@ -127,50 +178,335 @@ spec:
             port: 2375
 `
 
-// Install installs server components
-func Install(k kubectl.CLI, out *output.Interface) error {
+func tolerations(flags []string) ([]map[string]interface{}, error) {
+	var tolerations []map[string]interface{}
+
+	for _, flag := range flags {
+		if flag == "*" {
+			tolerations = append(tolerations, map[string]interface{}{
+				"operator": "Exists",
+			})
+			continue
+		}
+		t := map[string]interface{}{}
+		keyValue := flag
+		if i := strings.LastIndex(flag, ":"); i >= 0 {
+			keyValue, t["effect"] = flag[:i], flag[i+1:]
+		}
+		if kv := strings.SplitN(keyValue, "=", 2); len(kv) == 2 {
+			t["key"], t["operator"], t["value"] = kv[0], "Equal", kv[1]
+		} else {
+			t["key"], t["operator"] = kv[0], "Exists"
+		}
+		if t["key"] == "" {
+			return nil, fmt.Errorf(`invalid toleration "%s"`, flag)
+		}
+		tolerations = append(tolerations, t)
+	}
+
+	return tolerations, nil
+}
+
+// manifest generates the manifest of the server components,
+// which run as a daemon set or, if a node is specified, as
+// a pod on that node, and stamps it with the kdo version and
+// the digest of the manifest, which also names the configuration
+// so that a daemon set rolled back to a previous revision runs
+// with the configuration of that revision; it returns both the
+// manifest and its digest
+func manifest(options *Options, node string) (string, string, error) {
+	nodeSelector := map[string]string{}
+	for k, v := range options.NodeSelector {
+		nodeSelector[k] = v
+	}
+	nodeSelector["kubernetes.io/os"] = "linux"
+	tolerations, err := tolerations(options.Tolerations)
+	if err != nil {
+		return "", "", err
+	}
+
+	t, err := template.New("manifest").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}).Parse(manifestTemplate)
+	if err != nil {
+		return "", "", err
+	}
+	data := map[string]interface{}{
+		"Config":       "kdo-server",
+		"Image":        options.Image,
+		"CacheSize":    options.CacheSize,
+		"NodeSelector": nodeSelector,
+		"Tolerations":  tolerations,
+	}
+	var buf bytes.Buffer
+	if err = t.Execute(&buf, data); err != nil {
+		return "", "", err
+	}
+	digest := fmt.Sprintf("%x", sha256.Sum256(buf.Bytes()))
+	data["Config"] = configName(digest)
+	data["Annotations"] = map[string]string{
+		versionAnnotation: options.Version,
+		digestAnnotation:  digest,
+	}
+	buf.Reset()
+	if err = t.Execute(&buf, data); err != nil {
+		return "", "", err
+	}
+	if node == "" {
+		return buf.String(), digest, nil
+	}
+
+	docs := strings.SplitN(buf.String(), "\n---\n", 2)
+	var daemonSet map[string]interface{}
+	if err = yaml.Unmarshal([]byte(docs[1]), &daemonSet); err != nil {
+		return "", "", err
+	}
+	pod := daemonSet["spec"].(map[string]interface{})["template"].(map[string]interface{})
+	pod["apiVersion"] = "v1"
+	pod["kind"] = "Pod"
+	pod["metadata"].(map[string]interface{})["name"] = nodePodName(node)
+	// The pod is bound to the node, bypassing the scheduler,
+	// so it must not be restricted to a different set of nodes
+	spec := pod["spec"].(map[string]interface{})
+	spec["nodeName"] = node
+	spec["nodeSelector"] = map[string]interface{}{
+		"kubernetes.io/os": "linux",
+	}
+	podData, err := yaml.Marshal(pod)
+	if err != nil {
+		return "", "", err
+	}
+
+	return docs[0] + "\n---\n" + string(podData), digest, nil
+}
+
+func configName(digest string) string {
+	return "kdo-server-" + digest[:10]
+}
+
+func nodePodName(node string) string {
+	return "kdo-server-" + node
+}
+
+// annotation generates a template that gets an annotation of an object
+func annotation(key string) string {
+	return `{{range $k, $v := .metadata.annotations}}{{if eq $k "` + key + `"}}{{$v}}{{end}}{{end}}`
+}
+
+// compareVersions compares two dotted version numbers,
+// ignoring any suffix of each of their components
+func compareVersions(a string, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(strings.TrimRightFunc(as[i], func(r rune) bool { return r < '0' || r > '9' }))
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(strings.TrimRightFunc(bs[i], func(r rune) bool { return r < '0' || r > '9' }))
+		}
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+	}
+	return 0
+}
+
+// stamp represents the stamp of an installed daemon set
+type stamp struct {
+	version        string
+	digest         string
+	rolledBackFrom string
+}
+
+// installed gets the stamp of the installed daemon
+// set, or nil if the daemon set is not installed
+func installed(k kubectl.CLI, options *Options) (*stamp, error) {
+	lines, err := k.Lines("--namespace", options.Namespace, "get", "daemonset", "kdo-server", "--ignore-not-found", "--output",
+		"go-template={{with .spec.template}}"+annotation(versionAnnotation)+"\n"+annotation(digestAnnotation)+"{{end}}\n"+
+			annotation(rolledBackFromAnnotation)+"\n")
+	if err != nil {
+		return nil, err
+	} else if len(lines) < 3 {
+		return nil, nil
+	}
+
+	return &stamp{
+		version:        lines[0],
+		digest:         lines[1],
+		rolledBackFrom: lines[2],
+	}, nil
+}
+
+// awaitRollout waits for all instances of the daemon set to be updated and ready
+func awaitRollout(k kubectl.CLI, options *Options, op output.Operation) error {
+	for {
+		status, err := k.String("--namespace", options.Namespace, "get", "daemonset", "kdo-server", "--output",
+			"go-template={{.metadata.generation}} {{.status.observedGeneration}} {{.status.updatedNumberScheduled}} {{.status.numberReady}} {{.status.desiredNumberScheduled}}")
+		if err != nil {
+			return err
+		}
+		var values [5]int
+		for i, token := range strings.Split(status, " ") {
+			// Fields that are zero may be omitted
+			if i < len(values) && token != "<no value>" {
+				if values[i], err = strconv.Atoi(token); err != nil {
+					return err
+				}
+			}
+		}
+		generation, observed, updated, ready, desired := values[0], values[1], values[2], values[3], values[4]
+		if observed >= generation {
+			if updated < desired {
+				op.Progress("%d/%d instances are updated", updated, desired)
+			} else {
+				op.Progress("%d/%d instances are ready", ready, desired)
+				if ready == desired {
+					return nil
+				}
+			}
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// Install installs server components or upgrades
+// them to the manifest of this version of kdo
+func Install(k kubectl.CLI, options *Options, out *output.Interface) error {
 	return pkgerror(out.Do("Installing server components", func(op output.Operation) error {
 		op.Progress("applying manifest")
-		if err := k.Input(strings.NewReader(manifest), "--namespace", "kube-system", "apply", "--filename", "-"); err != nil {
+		m, digest, err := manifest(options, "")
+		if err != nil {
+			return err
+		}
+		if options.OnDemand {
+			// Only install the configuration
+			m = strings.SplitN(m, "\n---\n", 2)[0]
+		}
+		previousConfig, err := k.String("--namespace", options.Namespace, "get", "daemonset", "kdo-server", "--ignore-not-found",
+			"--output", "go-template={{range .spec.template.spec.volumes}}{{if .configMap}}{{.configMap.name}}{{end}}{{end}}")
+		if err != nil {
+			return err
+		}
+		if err = k.Input(strings.NewReader(m), "--namespace", options.Namespace, "apply", "--filename", "-"); err != nil {
+			return err
+		}
+		if options.OnDemand {
+			return nil
+		}
+		// Explicitly installing allows upgrading again
+		if err = k.Run("--namespace", options.Namespace, "annotate", "daemonset", "kdo-server", rolledBackFromAnnotation+"-"); err != nil {
 			return err
 		}
 
 		op.Progress("checking readiness")
-		for {
-			readiness, err := k.String("--namespace", "kube-system", "get", "daemonset", "kdo-server",
-				"--output", "go-template={{.status.numberReady}} {{.status.desiredNumberScheduled}}")
-			if err != nil {
-				return err
-			}
-			if readiness != "" {
-				tokens := strings.Split(readiness, " ")
-				current, err := strconv.Atoi(tokens[0])
-				if err != nil {
-					return err
-				}
-				desired, err := strconv.Atoi(tokens[1])
-				if err != nil {
+		if err = awaitRollout(k, options, op); err != nil {
+			return err
+		}
+
+		// Keep the configuration of the previous revision,
+		// to which the daemon set may be rolled back
+		op.Progress("removing unused configuration")
+		configs, err := k.Lines("--namespace", options.Namespace, "get", "configmap", "--selector", "component=kdo-server",
+			"--output", "go-template={{range .items}}{{.metadata.name}}\n{{end}}")
+		if err != nil {
+			return err
+		}
+		for _, config := range configs {
+			if config != configName(digest) && config != previousConfig {
+				if err = k.Run("--namespace", options.Namespace, "delete", "configmap", config, "--ignore-not-found"); err != nil {
 					return err
 				}
-				op.Progress("%d/%d instances are ready", current, desired)
-				if current == desired {
-					break
-				}
 			}
-			time.Sleep(1 * time.Second)
 		}
 
 		return nil
 	}))
 }
 
-// NodePods first ensures server components are installed
-// and then gets a map of nodes to server component pods
-func NodePods(k kubectl.CLI, out *output.Interface) (map[string]string, error) {
+// upgradable compares the installed daemon set with this version
+// of kdo, indicating if it should be upgraded, or warning about
+// version skew that is not resolved by upgrading it
+func upgradable(k kubectl.CLI, options *Options, out *output.Interface) (bool, error) {
+	s, err := installed(k, options)
+	if err != nil || s == nil {
+		return false, err
+	}
+	_, digest, err := manifest(options, "")
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case s.digest == digest:
+		return false, nil
+	case s.rolledBackFrom != "" && compareVersions(options.Version, s.rolledBackFrom) <= 0:
+		out.Warning("Server components were rolled back from version %s; run kdo --install to upgrade them", s.rolledBackFrom)
+	case s.version == "":
+		out.Info("Upgrading server components to version %s", options.Version)
+		return true, nil
+	case compareVersions(s.version, options.Version) < 0:
+		out.Info("Upgrading server components from version %s to %s", s.version, options.Version)
+		return true, nil
+	case compareVersions(s.version, options.Version) > 0:
+		out.Warning("Server components are version %s, which is newer than this version of kdo (%s)", s.version, options.Version)
+	default:
+		out.Warning("Server components were installed with different options; run kdo --install to reinstall them")
+	}
+
+	return false, nil
+}
+
+// nodePod represents a server component pod on a node
+type nodePod struct {
+	node    string
+	name    string
+	ready   bool
+	version string
+	digest  string
+}
+
+// nodePodsTemplate gets server component pods that are not terminating
+var nodePodsTemplate = "go-template={{range .items}}{{if not .metadata.deletionTimestamp}}" +
+	"{{.spec.nodeName}} {{.metadata.name}} {{range .status.containerStatuses}}{{.ready}}{{end}} " +
+	annotation(versionAnnotation) + " " + annotation(digestAnnotation) + "\n{{end}}{{end}}"
+
+func getNodePods(k kubectl.CLI, options *Options) ([]nodePod, error) {
+	lines, err := k.Lines("--namespace", options.Namespace, "get", "pod", "--selector", "component=kdo-server",
+		"--output", nodePodsTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	var pods []nodePod
+	for _, line := range lines {
+		tokens := strings.Split(line, " ")
+		if len(tokens) < 5 {
+			continue
+		}
+		pods = append(pods, nodePod{
+			node:    tokens[0],
+			name:    tokens[1],
+			ready:   tokens[2] == "true",
+			version: tokens[3],
+			digest:  tokens[4],
+		})
+	}
+
+	return pods, nil
+}
+
+// NodePods first ensures server components are installed and
+// up to date and then gets a map of nodes to server component pods
+func NodePods(k kubectl.CLI, options *Options, out *output.Interface) (map[string]string, error) {
 	var nodePods map[string]string
 
-	pods, err := k.Lines("--namespace", "kube-system", "get", "pod", "--selector", "component=kdo-server",
-		"--output", "go-template={{range .items}}{{.spec.nodeName}} {{.metadata.name}} {{range .status.containerStatuses}}{{.ready}}{{end}}\n{{end}}")
+	pods, err := getNodePods(k, options)
 	if err != nil {
 		return nil, pkgerror(err)
 	}
@@ -178,26 +514,201 @@ func NodePods(k kubectl.CLI, out *output.Interface) (map[string]string, error) {
 	if len(pods) > 0 {
 		nodePods = map[string]string{}
 		for _, pod := range pods {
-			nodePodReady := strings.Split(pod, " ")
-			if nodePodReady[2] == "true" {
-				nodePods[nodePodReady[0]] = nodePodReady[1]
+			if pod.ready {
+				nodePods[pod.node] = pod.name
 			}
 		}
 	}
 
-	if nodePods == nil || len(nodePods) < len(pods) {
-		if err = Install(k, out); err != nil {
+	if options.OnDemand {
+		return nodePods, nil
+	}
+
+	var upgrade bool
+	if len(pods) > 0 {
+		if upgrade, err = upgradable(k, options, out); err != nil {
+			return nil, pkgerror(err)
+		}
+	}
+
+	if upgrade || nodePods == nil || len(nodePods) < len(pods) {
+		if err = Install(k, options, out); err != nil {
 			return nil, err
 		}
-		return NodePods(k, out)
+		return NodePods(k, options, out)
 	}
 
 	return nodePods, nil
 }
 
+// NodePod first ensures an up to date server component is running
+// on a node and then gets the name of its pod on that node
+func NodePod(k kubectl.CLI, options *Options, node string, out *output.Interface) (string, error) {
+	if !options.OnDemand {
+		nodePods, err := NodePods(k, options, out)
+		if err != nil {
+			return "", err
+		} else if nodePods[node] == "" {
+			return "", pkgerror(fmt.Errorf("no server component on node %s", node))
+		}
+		return nodePods[node], nil
+	}
+
+	name := nodePodName(node)
+	status, err := k.String("--namespace", options.Namespace, "get", "pod", name, "--ignore-not-found",
+		"--output", "go-template={{range .status.containerStatuses}}{{.ready}}{{end}} "+annotation(versionAnnotation))
+	if err != nil {
+		return "", pkgerror(err)
+	}
+	exists := status != ""
+	readyVersion := strings.SplitN(status+" ", " ", 2)
+	ready, version := readyVersion[0], strings.TrimSpace(readyVersion[1])
+	if exists && compareVersions(version, options.Version) < 0 {
+		if version == "" {
+			version = "unknown"
+		}
+		if err = out.Do("Upgrading server component on node %s from version %s to %s", node, version, options.Version, func() error {
+			return k.Run("--namespace", options.Namespace, "delete", "pod", name, "--ignore-not-found")
+		}); err != nil {
+			return "", pkgerror(err)
+		}
+		exists, ready = false, ""
+	}
+	if ready == "true" {
+		return name, nil
+	}
+
+	if err = out.Do("Starting server component on node %s", node, func(op output.Operation) error {
+		if !exists {
+			op.Progress("applying manifest")
+			m, _, err := manifest(options, node)
+			if err != nil {
+				return err
+			}
+			if err = k.Input(strings.NewReader(m), "--namespace", options.Namespace, "apply", "--filename", "-"); err != nil {
+				return err
+			}
+		}
+
+		op.Progress("checking readiness")
+		for {
+			ready, err := k.String("--namespace", options.Namespace, "get", "pod", name,
+				"--output", "go-template={{range .status.containerStatuses}}{{.ready}}{{end}}")
+			if err != nil {
+				return err
+			} else if ready == "true" {
+				return nil
+			}
+			time.Sleep(1 * time.Second)
+		}
+	}); err != nil {
+		return "", pkgerror(err)
+	}
+
+	return name, nil
+}
+
+// Rollback rolls the server components daemon set back to its
+// previous revision and prevents versions of kdo up to the one
+// that was rolled back from upgrading it again
+func Rollback(k kubectl.CLI, options *Options, out *output.Interface) error {
+	if options.OnDemand {
+		return pkgerror(errors.New("cannot roll back server components that run on demand"))
+	}
+
+	return pkgerror(out.Do("Rolling back server components", func(op output.Operation) error {
+		s, err := installed(k, options)
+		if err != nil {
+			return err
+		} else if s == nil {
+			return errors.New("server components are not installed")
+		}
+
+		op.Progress("undoing rollout")
+		if err = k.Run("--namespace", options.Namespace, "rollout", "undo", "daemonset/kdo-server"); err != nil {
+			return err
+		}
+		if s.version != "" {
+			if err = k.Run("--namespace", options.Namespace, "annotate", "daemonset", "kdo-server", "--overwrite",
+				rolledBackFromAnnotation+"="+s.version); err != nil {
+				return err
+			}
+		}
+
+		op.Progress("checking readiness")
+		return awaitRollout(k, options, op)
+	}))
+}
+
+// Status represents the status of server components
+type Status struct {
+	Kind string `json:"kind"`
+	// Version is the version of this client
+	Version string `json:"version"`
+	// Installed is the version of the installed daemon set
+	Installed      string       `json:"installed,omitempty"`
+	RolledBackFrom string       `json:"rolledBackFrom,omitempty"`
+	OnDemand       bool         `json:"onDemand"`
+	Nodes          []NodeStatus `json:"nodes"`
+}
+
+// NodeStatus represents the status of a server component on a node
+type NodeStatus struct {
+	Node    string `json:"node"`
+	Pod     string `json:"pod"`
+	Ready   bool   `json:"ready"`
+	Version string `json:"version"`
+	// Current indicates that the server component
+	// matches the manifest of this client
+	Current bool `json:"current"`
+}
+
+// GetStatus gets the versions of server components on each node
+func GetStatus(k kubectl.CLI, options *Options) (*Status, error) {
+	_, digest, err := manifest(options, "")
+	if err != nil {
+		return nil, pkgerror(err)
+	}
+
+	status := &Status{
+		Kind:     "serverStatus",
+		Version:  options.Version,
+		OnDemand: options.OnDemand,
+		Nodes:    []NodeStatus{},
+	}
+	if !options.OnDemand {
+		s, err := installed(k, options)
+		if err != nil {
+			return nil, pkgerror(err)
+		} else if s != nil {
+			status.Installed = s.version
+			status.RolledBackFrom = s.rolledBackFrom
+		}
+	}
+
+	pods, err := getNodePods(k, options)
+	if err != nil {
+		return nil, pkgerror(err)
+	}
+	for _, pod := range pods {
+		status.Nodes = append(status.Nodes, NodeStatus{
+			Node:    pod.node,
+			Pod:     pod.name,
+			Ready:   pod.ready,
+			Version: pod.version,
+			Current: pod.digest == digest,
+		})
+	}
+	sort.Slice(status.Nodes, func(i, j int) bool {
+		return status.Nodes[i].Node < status.Nodes[j].Node
+	})
+
+	return status, nil
+}
+
 // Uninstall uninstalls server components
-func Uninstall(k kubectl.CLI, out *output.Interface) error {
+func Uninstall(k kubectl.CLI, options *Options, out *output.Interface) error {
 	return pkgerror(out.Do("Uninstalling server components", func() error {
-		return k.Run("--namespace", "kube-system", "delete", "daemonset,configmap", "--selector", "component=kdo-server")
+		return k.Run("--namespace", options.Namespace, "delete", "daemonset,pod,configmap", "--selector", "component=kdo-server")
 	}))
 }